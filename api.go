@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// apiDateFormat is the format of the dates accepted and returned by the api
+const apiDateFormat = "2006-01-02"
+
+// apiTrain is a train returned by the json api
+type apiTrain struct {
+	ID                string
+	Title             string
+	Subtitle          string
+	URL               string
+	ImageURL          string `json:",omitempty"`
+	Region            string
+	Locomotive        string
+	LocomotiveDetails string `json:",omitempty"`
+	Timeless          bool
+	// Date is the day of the train (YYYY-MM-DD), Departure is set only if the train has a time
+	Date             string
+	Departure        *time.Time `json:",omitempty"`
+	Arrive           *time.Time `json:",omitempty"`
+	ReturnDeparture  *time.Time `json:",omitempty"`
+	ReturnArrive     *time.Time `json:",omitempty"`
+	DepartureStation string
+	ArriveStation    string
+	Prices           apiPrices
+	// Status is one of scheduled, past, removed or cancelled, it is missing in the old versions of the history
+	Status      string `json:",omitempty"`
+	CalendarURL string `json:",omitempty"`
+	PageURL     string `json:",omitempty"`
+}
+
+type apiPrices struct {
+	Adult          string `json:",omitempty"`
+	Children       string `json:",omitempty"`
+	AdultReturn    string `json:",omitempty"`
+	ChildrenReturn string `json:",omitempty"`
+}
+
+// apiVersion is a version of a train returned by the history api
+type apiVersion struct {
+	Seen    time.Time
+	Train   apiTrain
+	Changes []FieldChange `json:",omitempty"`
+}
+
+type apiRegion struct {
+	Name   string
+	Trains int
+}
+
+var trainStatusNames = map[trainStatus]string{
+	trainScheduled: "scheduled",
+	trainPast:      "past",
+	trainRemoved:   "removed",
+	trainCancelled: "cancelled",
+}
+
+func (s *HttpServer) newApiTrain(train Train, status trainStatus) apiTrain {
+	t := apiTrain{
+		ID:                train.UniqueID(),
+		Title:             train.Title,
+		Subtitle:          train.Subtitle,
+		URL:               BaseURL + strings.TrimPrefix(train.Link, "/"),
+		Region:            train.Region,
+		Locomotive:        train.Locomotive,
+		LocomotiveDetails: train.LocomotiveDetails,
+		Timeless:          train.IsTimeless,
+		DepartureStation:  train.DepartureStation,
+		ArriveStation:     train.ArriveStation,
+		Prices: apiPrices{
+			Adult:          train.PriceAdult,
+			Children:       train.PriceChildren,
+			AdultReturn:    train.PriceAdultReturn,
+			ChildrenReturn: train.PriceChildrenReturn,
+		},
+		Status: trainStatusNames[status],
+	}
+	if train.ImageURL != "" {
+		t.ImageURL = BaseURL + strings.TrimPrefix(train.ImageURL, "/")
+	}
+	if when, err := train.When(); err == nil {
+		t.Date = when.Format(apiDateFormat)
+	}
+	if ok, departure, arrive := train.DepartureArriveTime(); ok {
+		t.Departure, t.Arrive = &departure, &arrive
+		if ok, departure, arrive := train.ReturnDepartureArriveTime(); ok {
+			t.ReturnDeparture, t.ReturnArrive = &departure, &arrive
+		}
+	}
+	_, t.CalendarURL = httpAddressForTrain(train, s.HttpPublicAddress, "/ics/")
+	_, t.PageURL = httpAddressForTrain(train, s.HttpPublicAddress, "/html/")
+
+	return t
+}
+
+// apiQuery is the filter of the trains api
+type apiQuery struct {
+	TrainFilter
+	From     time.Time
+	To       time.Time
+	HasPrice *bool
+}
+
+// parseApiQuery parses the filters of filterFromQuery, the date range from and to (YYYY-MM-DD, inclusive)
+// and has-price (1 or 0). Without from only the upcoming trains are returned.
+func parseApiQuery(query url.Values, now time.Time) (apiQuery, error) {
+	var q apiQuery
+	var err error
+	q.TrainFilter, err = filterFromQuery(query)
+	if err != nil {
+		return q, err
+	}
+
+	q.From = now
+	if from := query.Get("from"); from != "" {
+		q.From, err = time.ParseInLocation(apiDateFormat, from, timezone)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %q", from)
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		q.To, err = time.ParseInLocation(apiDateFormat, to, timezone)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %q", to)
+		}
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+	if hasPrice := query.Get("has-price"); hasPrice != "" {
+		value, err := strconv.ParseBool(hasPrice)
+		if err != nil {
+			return q, fmt.Errorf("invalid has-price: %q", hasPrice)
+		}
+		q.HasPrice = &value
+	}
+
+	return q, nil
+}
+
+func (q apiQuery) Match(train Train, when time.Time) bool {
+	if when.Before(q.From) || (!q.To.IsZero() && !when.Before(q.To)) {
+		return false
+	}
+	if q.HasPrice != nil {
+		if _, ok := train.Price(); ok != *q.HasPrice {
+			return false
+		}
+	}
+	return q.TrainFilter.Match(train)
+}
+
+// writeJSON writes v with an ETag
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln("Cannot encode response:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeWithETag(w, r, "application/json", body)
+}
+
+// writeWithETag writes body with an ETag, answering 304 when the client already has it
+func writeWithETag(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := md5.Sum(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// etagMatch reports if the If-None-Match header contains etag
+func etagMatch(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// apiError writes the error as json
+func apiError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct{ Error string }{msg})
+}
+
+func (s *HttpServer) handleApiTrains(w http.ResponseWriter, r *http.Request) {
+	query, err := parseApiQuery(r.URL.Query(), s.clock.Now())
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	trains, err := s.catalogue.Trains(r.Context())
+	if err != nil {
+		log.Errorln("Cannot load trains:", err)
+		apiError(w, "Cannot load trains", http.StatusInternalServerError)
+		return
+	}
+
+	type found struct {
+		train apiTrain
+		when  time.Time
+	}
+	published := make(map[string]bool, len(trains))
+	var results []found
+	add := func(train Train, status trainStatus) {
+		when, err := train.When()
+		if err != nil || !query.Match(train, when) {
+			return
+		}
+		if s.archive.IsCancelled(train.UniqueID()) {
+			status = trainCancelled
+		} else if when.Before(s.clock.Now()) {
+			status = trainPast
+		}
+		results = append(results, found{s.newApiTrain(train, status), when})
+	}
+	for _, train := range trains {
+		published[train.UniqueID()] = true
+		add(train, trainScheduled)
+	}
+	for _, train := range s.archive.Withdrawn(query.From) {
+		if !published[train.UniqueID()] {
+			add(train, trainCancelled)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if !results[i].when.Equal(results[j].when) {
+			return results[i].when.Before(results[j].when)
+		}
+		return results[i].train.ID < results[j].train.ID
+	})
+	list := make([]apiTrain, 0, len(results))
+	for _, res := range results {
+		list = append(list, res.train)
+	}
+	writeJSON(w, r, list)
+}
+
+// handleApiTrain returns a train, or its history when the path ends with /history
+func (s *HttpServer) handleApiTrain(w http.ResponseWriter, r *http.Request) {
+	trainID, history := strings.CutSuffix(r.PathValue("id"), "/history")
+	if history {
+		s.handleApiTrainHistory(w, r, trainID)
+		return
+	}
+
+	train, status, err := s.findTrain(r.Context(), trainID)
+	if err != nil {
+		if errors.Is(err, errTrainNotFound) {
+			apiError(w, "Train not found", http.StatusNotFound)
+			return
+		}
+		log.Errorln("Cannot load trains:", err)
+		apiError(w, "Cannot load trains", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, s.newApiTrain(train, status))
+}
+
+func (s *HttpServer) handleApiTrainHistory(w http.ResponseWriter, r *http.Request, trainID string) {
+	history, found := s.archive.History(trainID)
+	if !found {
+		apiError(w, "Train not found", http.StatusNotFound)
+		return
+	}
+
+	versions := make([]apiVersion, 0, len(history))
+	for _, v := range history {
+		versions = append(versions, apiVersion{
+			Seen:    v.Seen,
+			Train:   s.newApiTrain(v.Train.WithClock(s.clock), trainScheduled),
+			Changes: v.Changes,
+		})
+		versions[len(versions)-1].Train.Status = ""
+	}
+	// Only the last version has a status
+	if len(versions) > 0 {
+		_, status, err := s.findTrain(r.Context(), trainID)
+		if err == nil {
+			versions[len(versions)-1].Train.Status = trainStatusNames[status]
+		}
+	}
+	writeJSON(w, r, versions)
+}
+
+// handleApiRegions returns the regions of the upcoming trains
+func (s *HttpServer) handleApiRegions(w http.ResponseWriter, r *http.Request) {
+	trains, err := s.catalogue.Trains(r.Context())
+	if err != nil {
+		log.Errorln("Cannot load trains:", err)
+		apiError(w, "Cannot load trains", http.StatusInternalServerError)
+		return
+	}
+
+	now := s.clock.Now()
+	counts := make(map[string]int)
+	for _, train := range trains {
+		when, err := train.When()
+		if err != nil || when.Before(now) || train.Region == "" {
+			continue
+		}
+		counts[train.Region]++
+	}
+
+	regions := make([]apiRegion, 0, len(counts))
+	for name, count := range counts {
+		regions = append(regions, apiRegion{Name: name, Trains: count})
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Name < regions[j].Name })
+	writeJSON(w, r, regions)
+}
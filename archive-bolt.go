@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+var boltTrainsBucket = []byte("trains")
+var boltStateBucket = []byte("state")
+var boltStateKey = []byte("state")
+
+// errArchiveLocked is returned when the database is held by another process, usually the running bot
+var errArchiveLocked = errors.New("the archive database is in use by another process")
+
+// BoltStore saves each train of the archive as a row of a bbolt database
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltTrainsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltStateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create bucket: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// OpenBoltStoreReadOnly opens an existing database without modifying it, the store cannot be saved
+func OpenBoltStoreReadOnly(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if errors.Is(err, bolterrors.ErrTimeout) {
+		return nil, errArchiveLocked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) IsEmpty() (bool, error) {
+	empty := true
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(boltTrainsBucket).Cursor().First()
+		empty = k == nil
+		return nil
+	})
+	return empty, err
+}
+
+func (s *BoltStore) Load() (map[string]trainArchiveValue, archiveState, error) {
+	records := make(map[string]trainArchiveValue)
+	var state archiveState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stateBucket, trainsBucket := tx.Bucket(boltStateBucket), tx.Bucket(boltTrainsBucket)
+		if stateBucket == nil || trainsBucket == nil {
+			// Only a database never opened for writing has no buckets
+			return nil
+		}
+
+		if body := stateBucket.Get(boltStateKey); body != nil {
+			err := json.Unmarshal(body, &state)
+			if err != nil {
+				return fmt.Errorf("cannot decode state: %w", err)
+			}
+		}
+
+		return trainsBucket.ForEach(func(k, v []byte) error {
+			var record trainArchiveValue
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return fmt.Errorf("cannot decode train %q: %w", k, err)
+			}
+			records[string(k)] = record
+			return nil
+		})
+	})
+
+	return records, state, err
+}
+
+// Save writes only the changed records
+func (s *BoltStore) Save(records map[string]trainArchiveValue, changed []string, state archiveState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		body, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltStateBucket).Put(boltStateKey, body)
+		if err != nil {
+			return err
+		}
+
+		bucket := tx.Bucket(boltTrainsBucket)
+		for _, id := range changed {
+			record, found := records[id]
+			if !found {
+				err := bucket.Delete([]byte(id))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(id), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Incremental() bool {
+	return true
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
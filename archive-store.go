@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TrainArchiveFile is the default file of the train archive
+const TrainArchiveFile = "trains.hash"
+
+// TrainArchiveBackups is the number of previous versions of the archive file kept on save
+const TrainArchiveBackups = 3
+
+// TrainArchiveStore persists the records of a TrainArchive, indexed by UniqueID, and the state of the bot
+type TrainArchiveStore interface {
+	Load() (map[string]trainArchiveValue, archiveState, error)
+	// Save persists the records and the state, changed contains the ids modified since the last save
+	Save(records map[string]trainArchiveValue, changed []string, state archiveState) error
+	// Incremental reports if Save writes only the changed records instead of every record
+	Incremental() bool
+	Close() error
+}
+
+// archiveState is the state of the bot not related to a single train
+type archiveState struct {
+	// LastDigest is the time the last digest was sent to each chat
+	LastDigest map[int64]time.Time `json:",omitempty"`
+	// Pinned is the pinned message with the next departures of each chat
+	Pinned map[int64]pinnedMessage `json:",omitempty"`
+}
+
+type pinnedMessage struct {
+	MessageID int
+	// TextHash is the hash of the text of the message, used to skip unneeded edits
+	TextHash string
+}
+
+// OpenTrainArchiveStore opens the store selected by the config, by default TrainArchiveFile.
+// When ArchiveDatabase is used for the first time the records are migrated from TrainArchiveFile.
+func OpenTrainArchiveStore(cfg Config) (TrainArchiveStore, error) {
+	if cfg.ArchiveDatabase == "" {
+		return NewJSONFileStore(TrainArchiveFile), nil
+	}
+
+	store, err := OpenBoltStore(cfg.ArchiveDatabase)
+	if err != nil {
+		return nil, err
+	}
+
+	empty, err := store.IsEmpty()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if _, statErr := os.Stat(TrainArchiveFile); empty && statErr == nil {
+		log.Infoln("Migrating train archive from", TrainArchiveFile, "to", cfg.ArchiveDatabase)
+		err = MigrateTrainArchiveStore(NewJSONFileStore(TrainArchiveFile), store)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// OpenTrainArchiveStoreReadOnly opens the store selected by the config without migrating or modifying it
+func OpenTrainArchiveStoreReadOnly(cfg Config) (TrainArchiveStore, error) {
+	if cfg.ArchiveDatabase == "" {
+		return NewJSONFileStore(TrainArchiveFile), nil
+	}
+
+	return OpenBoltStoreReadOnly(cfg.ArchiveDatabase)
+}
+
+// MigrateTrainArchiveStore copies every record from src to dst
+func MigrateTrainArchiveStore(src TrainArchiveStore, dst TrainArchiveStore) error {
+	records, state, err := src.Load()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+
+	return dst.Save(records, ids, state)
+}
+
+// JSONFileStore saves the whole archive as a json file, the file is replaced atomically
+// keeping TrainArchiveBackups backups
+type JSONFileStore struct {
+	Path string
+}
+
+// jsonArchiveFile is the content of the json file, files created by older versions
+// only contain the trains map and have no Version
+type jsonArchiveFile struct {
+	Version int
+	Trains  map[string]trainArchiveValue
+	State   archiveState
+}
+
+const jsonArchiveVersion = 2
+
+func NewJSONFileStore(path string) *JSONFileStore {
+	return &JSONFileStore{Path: path}
+}
+
+// Load reads the archive, if the file is corrupted or missing the newest readable backup is used.
+// An empty archive is returned if neither exists.
+func (s *JSONFileStore) Load() (map[string]trainArchiveValue, archiveState, error) {
+	file, err := loadJSONArchiveFile(s.Path)
+	if err == nil {
+		return file.Trains, file.State, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Errorln("Cannot load train archive, trying backups:", err)
+	}
+
+	for n := 1; n <= TrainArchiveBackups; n++ {
+		backup := backupFile(s.Path, n)
+		file, backupErr := loadJSONArchiveFile(backup)
+		if backupErr == nil {
+			log.Warnln("Train archive recovered from backup:", backup)
+			return file.Trains, file.State, nil
+		}
+		if !os.IsNotExist(backupErr) {
+			log.Errorln("Cannot load train archive backup:", backup, backupErr)
+		}
+	}
+
+	if os.IsNotExist(err) {
+		log.Infoln("Creating new train archive:", s.Path)
+		return make(map[string]trainArchiveValue), archiveState{}, nil
+	}
+	return nil, archiveState{}, err
+}
+
+func loadJSONArchiveFile(file string) (jsonArchiveFile, error) {
+	var content jsonArchiveFile
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return content, err
+	}
+
+	err = json.Unmarshal(body, &content)
+	if err != nil {
+		legacy, legacyErr := decodeLegacyJSONArchive(body)
+		if legacyErr != nil {
+			return content, err
+		}
+		log.Warnln("Train archive has trailing data, it is ignored and removed with the next save:", file, err)
+		return legacy, nil
+	}
+	if content.Version == 0 {
+		// Created by an older version
+		content.Trains = nil
+		err = json.Unmarshal(body, &content.Trains)
+	}
+	return content, err
+}
+
+func (s *JSONFileStore) Save(records map[string]trainArchiveValue, changed []string, state archiveState) error {
+	bytes, err := json.MarshalIndent(jsonArchiveFile{
+		Version: jsonArchiveVersion,
+		Trains:  records,
+		State:   state,
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.Path, bytes, 0644, TrainArchiveBackups)
+}
+
+func (s *JSONFileStore) Incremental() bool {
+	return false
+}
+
+func (s *JSONFileStore) Close() error {
+	return nil
+}
+
+// decodeLegacyJSONArchive decodes the first value of a file created by an older version,
+// which ignored the data after the trains
+func decodeLegacyJSONArchive(body []byte) (jsonArchiveFile, error) {
+	var content jsonArchiveFile
+	err := json.NewDecoder(bytes.NewReader(body)).Decode(&content)
+	if err != nil {
+		return content, err
+	}
+	if content.Version != 0 {
+		return content, fmt.Errorf("version %d with trailing data", content.Version)
+	}
+
+	content.Trains = nil
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&content.Trains)
+	return content, err
+}
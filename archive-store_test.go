@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestJSONFileStoreLoad(t *testing.T) {
+	const (
+		current = `{"Version": 2, "Trains": {"current": {"TrainHash": "a"}}}`
+		backup  = `{"Version": 2, "Trains": {"backup": {"TrainHash": "b"}}}`
+		legacy  = `{"legacy": {"MessageID": 12, "TrainHash": "c"}}`
+	)
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "missing", want: []string{}},
+		{name: "current", files: map[string]string{"trains.hash": current}, want: []string{"current"}},
+		{name: "legacy", files: map[string]string{"trains.hash": legacy}, want: []string{"legacy"}},
+		{
+			name:  "legacy with trailing data",
+			files: map[string]string{"trains.hash": legacy + `}, "old": {}}`},
+			want:  []string{"legacy"},
+		},
+		{
+			name:  "corrupted",
+			files: map[string]string{"trains.hash": current[:20], "trains.hash.bak.1": backup},
+			want:  []string{"backup"},
+		},
+		{
+			name:  "trailing data",
+			files: map[string]string{"trains.hash": current + "}", "trains.hash.bak.1": backup},
+			want:  []string{"backup"},
+		},
+		{
+			name:  "corrupted backup",
+			files: map[string]string{"trains.hash": "", "trains.hash.bak.1": "{", "trains.hash.bak.2": backup},
+			want:  []string{"backup"},
+		},
+		{
+			name:  "missing with backup",
+			files: map[string]string{"trains.hash.bak.1": backup},
+			want:  []string{"backup"},
+		},
+		{name: "corrupted without backups", files: map[string]string{"trains.hash": "{"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			records, _, err := NewJSONFileStore(filepath.Join(dir, "trains.hash")).Load()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Load() = %v, want an error", records)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error: %v", err)
+			}
+
+			got := make([]string, 0, len(records))
+			for id := range records {
+				got = append(got, id)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Load() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,25 +1,61 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
-	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 type TrainID string
 
+// TrainArchive keeps track of the trains already sent, the records are persisted by a TrainArchiveStore
 type TrainArchive struct {
+	mu   sync.RWMutex
 	hash map[string]trainArchiveValue
+	// dirty contains the changed records, seenDirty the records whose only change is LastSeen
+	dirty      map[string]bool
+	seenDirty  map[string]bool
+	state      archiveState
+	stateDirty bool
+	store      TrainArchiveStore
+	clock      Clock
 }
 type trainArchiveValue struct {
-	MessageID int
-	TrainHash string
+	// MessageID is the message in the channel, it is set only in the records archived by older versions
+	// (0 when sent dry) and it is moved in MessageIDs by MigrateMessageIDs
+	MessageID *int `json:",omitempty"`
+	// MessageIDs contains the message of the train for each chat,
+	// a message id of 0 means the train was sent dry
+	MessageIDs map[int64]int `json:",omitempty"`
+	TrainHash  string
+	FirstSeen  time.Time `json:",omitempty"`
+	LastSeen   time.Time `json:",omitempty"`
+	// Train is the last version of the train that was sent,
+	// archives created by older versions don't have it
+	Train *Train `json:",omitempty"`
+	// History contains every version of the train, the last one is Train
+	History []TrainVersion `json:",omitempty"`
+	// MissingRuns is the number of consecutive runs in which the train was not published
+	MissingRuns int `json:",omitempty"`
+	// Cancelled is set when the train disappeared before departing
+	Cancelled   bool      `json:",omitempty"`
+	CancelledAt time.Time `json:",omitempty"`
+	// Reminders contains the days before departure of the reminders already sent for each chat
+	Reminders map[int64][]int `json:",omitempty"`
+	// Revision counts the changes of the train: new versions, cancellations and restores.
+	// ModifiedAt is the time of the last one.
+	Revision   int       `json:",omitempty"`
+	ModifiedAt time.Time `json:",omitempty"`
+	// SubscribersNotified is true when the train was sent to the subscribers of the interactive bot,
+	// it is missing only in the records archived before the subscribers were tracked
+	SubscribersNotified *bool `json:",omitempty"`
 }
 
-func LoadTrainArchive(r io.Reader) (*TrainArchive, error) {
-	var ta TrainArchive
-	err := json.NewDecoder(r).Decode(&ta)
-	return &ta, err
+// trainRevision is the revision of an archived train, used by the calendars
+type trainRevision struct {
+	Sequence  int
+	Modified  time.Time
+	Cancelled bool
 }
 
 type TrainArchiveCompare int
@@ -30,72 +66,566 @@ const (
 	TrainSaved
 )
 
-func LoadTrainArchiveFromFile(file string) (*TrainArchive, error) {
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		os.WriteFile(file, []byte("{}"), 0655)
-	}
-	fl, err := os.Open(file)
+// NewTrainArchive loads the archive from store
+func NewTrainArchive(store TrainArchiveStore, clock Clock) (*TrainArchive, error) {
+	hash, state, err := store.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	return LoadTrainArchive(fl)
+	return newTrainArchive(hash, state, store, clock), nil
 }
 
-func (t *TrainArchive) SaveAsFile(file string) error {
-	fl, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0655)
-	if err != nil {
-		return err
+// NewEmptyTrainArchive creates an archive without records, used when store cannot be loaded
+// to serve the trains without sending them. It must not be saved.
+func NewEmptyTrainArchive(store TrainArchiveStore, clock Clock) *TrainArchive {
+	return newTrainArchive(nil, archiveState{}, store, clock)
+}
+
+func newTrainArchive(hash map[string]trainArchiveValue, state archiveState, store TrainArchiveStore, clock Clock) *TrainArchive {
+	if hash == nil {
+		hash = make(map[string]trainArchiveValue)
 	}
 
-	bytes, err := json.MarshalIndent(t, "", "\t")
-	if err != nil {
-		return err
+	return &TrainArchive{
+		hash:      hash,
+		dirty:     make(map[string]bool),
+		seenDirty: make(map[string]bool),
+		state:     state,
+		store:     store,
+		clock:     clock,
+	}
+}
+
+// MigrateMessageIDs moves the message id of trains archived by older versions to chatID,
+// the migrated records are saved without MessageID so they are migrated only once
+func (t *TrainArchive) MigrateMessageIDs(chatID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, v := range t.hash {
+		if v.MessageID == nil {
+			continue
+		}
+		if v.MessageIDs == nil {
+			v.MessageIDs = make(map[int64]int)
+		}
+		v.MessageIDs[chatID] = *v.MessageID
+		v.MessageID = nil
+		t.set(id, v)
+	}
+}
+
+// MigrateSubscribersNotified sets SubscribersNotified in the records archived by older versions,
+// which sent to the subscribers every train sent to a destination.
+// It must be called after MigrateMessageIDs.
+func (t *TrainArchive) MigrateSubscribersNotified() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, v := range t.hash {
+		if v.SubscribersNotified != nil {
+			continue
+		}
+		notified := len(v.MessageIDs) > 0
+		v.SubscribersNotified = &notified
+		t.set(id, v)
 	}
+}
+
+// Save persists the records changed since the last save
+func (t *TrainArchive) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	_, err = fl.Write(bytes)
+	changed := make([]string, 0, len(t.dirty))
+	for id := range t.dirty {
+		changed = append(changed, id)
+	}
+	if t.store.Incremental() {
+		// Writing a record is cheap, save LastSeen too
+		for id := range t.seenDirty {
+			if !t.dirty[id] {
+				changed = append(changed, id)
+			}
+		}
+	}
+	if len(changed) == 0 && !t.stateDirty {
+		return nil
+	}
+
+	err := t.store.Save(t.hash, changed, t.state)
 	if err != nil {
 		return err
 	}
 
+	t.dirty = make(map[string]bool)
+	t.seenDirty = make(map[string]bool)
+	t.stateDirty = false
 	return nil
 }
 
-func (t *TrainArchive) Add(train Train, msgID int) {
-	if t.hash == nil {
-		t.hash = make(map[string]trainArchiveValue)
+func (t *TrainArchive) Close() error {
+	return t.store.Close()
+}
+
+func (t *TrainArchive) set(id string, v trainArchiveValue) {
+	t.hash[id] = v
+	t.dirty[id] = true
+}
+
+// Add saves the train as sent in chatID with msgID
+func (t *TrainArchive) Add(train Train, chatID int64, msgID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	v, found := t.hash[train.UniqueID()]
+	if !found {
+		v.FirstSeen = now
+		v.SubscribersNotified = new(bool)
+	}
+	if v.MessageIDs == nil {
+		v.MessageIDs = make(map[int64]int)
 	}
 
-	t.hash[train.UniqueID()] = trainArchiveValue{
-		MessageID: msgID,
-		TrainHash: train.Hash(),
+	v.MessageIDs[chatID] = msgID
+	if v.TrainHash != train.Hash() {
+		v.addVersion(train, now)
 	}
+	v.LastSeen = now
+	t.set(train.UniqueID(), v)
+}
+
+// MarkSubscribersNotified saves the train as sent to the subscribers
+func (t *TrainArchive) MarkSubscribersNotified(train Train) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	v, found := t.hash[train.UniqueID()]
+	if !found {
+		v.FirstSeen = now
+	}
+	if v.TrainHash != train.Hash() {
+		v.addVersion(train, now)
+	}
+	v.LastSeen = now
+	notified := true
+	v.SubscribersNotified = &notified
+	t.set(train.UniqueID(), v)
+}
+
+// SubscribersNotified reports if the train was sent to the subscribers
+func (t *TrainArchive) SubscribersNotified(train Train) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	notified := t.hash[train.UniqueID()].SubscribersNotified
+	return notified != nil && *notified
+}
+
+// Update saves a new version of an already sent train, returning what changed
+func (t *TrainArchive) Update(train Train) []FieldChange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, found := t.hash[train.UniqueID()]
+	if !found {
+		return nil
+	}
+
+	now := t.clock.Now()
+	var changes []FieldChange
+	if v.Train == nil || v.TrainHash != train.Hash() {
+		changes = v.addVersion(train, now)
+	}
+	v.LastSeen = now
+	if v.Cancelled {
+		v.Cancelled = false
+		v.CancelledAt = time.Time{}
+		v.touch(now)
+	}
+	t.set(train.UniqueID(), v)
+	return changes
+}
+
+// addVersion appends train to the history and makes it the current version
+func (v *trainArchiveValue) addVersion(train Train, now time.Time) []FieldChange {
+	version := TrainVersion{Seen: now, Train: train}
+	if v.Train != nil {
+		if len(v.History) == 0 {
+			// Archived before the history was kept
+			v.History = append(v.History, TrainVersion{Seen: v.FirstSeen, Train: *v.Train})
+		}
+		version.Changes = DiffTrains(*v.Train, train)
+		v.touch(now)
+	} else {
+		v.ModifiedAt = now
+	}
+
+	v.History = append(v.History, version)
+	v.TrainHash = train.Hash()
+	v.Train = &train
+	return version.Changes
+}
+
+// touch records a change of the train
+func (v *trainArchiveValue) touch(now time.Time) {
+	v.Revision++
+	v.ModifiedAt = now
+}
+
+// Seen records that the train is still published
+func (t *TrainArchive) Seen(train Train) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, found := t.hash[train.UniqueID()]
+	if !found {
+		return
+	}
+
+	// LastSeen alone is saved only by incremental stores, the others save it with the next change
+	changed := v.MissingRuns != 0
+	v.LastSeen = t.clock.Now()
+	v.MissingRuns = 0
+	if v.Train == nil && v.TrainHash == train.Hash() {
+		// Archived by an older version, keep the train for the http server
+		v.Train = &train
+		v.History = []TrainVersion{{Seen: v.FirstSeen, Train: train}}
+		changed = true
+	}
+	if !changed {
+		t.hash[train.UniqueID()] = v
+		t.seenDirty[train.UniqueID()] = true
+		return
+	}
+	t.set(train.UniqueID(), v)
+}
+
+// Missing increments the missing runs of the future trains not in published,
+// returning the ones missing for at least runs consecutive runs that are not yet cancelled.
+// published must be the result of a successful import.
+func (t *TrainArchive) Missing(published []Train, runs int) []Train {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := make(map[string]bool, len(published))
+	for _, train := range published {
+		seen[train.UniqueID()] = true
+	}
+
+	now := t.clock.Now()
+	var missing []Train
+	for id, v := range t.hash {
+		if seen[id] || v.Cancelled || v.Train == nil {
+			continue
+		}
+
+		train := v.Train.WithClock(t.clock)
+		when, err := train.When()
+		if err != nil || when.Before(now) {
+			continue
+		}
+
+		v.MissingRuns++
+		t.set(id, v)
+		if v.MissingRuns >= runs {
+			missing = append(missing, train)
+		}
+	}
+
+	return missing
+}
+
+// Cancel marks the train as cancelled, until it is updated again
+func (t *TrainArchive) Cancel(train Train) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, found := t.hash[train.UniqueID()]
+	if !found {
+		return
+	}
+
+	v.Cancelled = true
+	v.CancelledAt = t.clock.Now()
+	v.touch(v.CancelledAt)
+	t.set(train.UniqueID(), v)
+}
+
+// Upcoming returns the archived trains departing after now that are not cancelled
+func (t *TrainArchive) Upcoming(now time.Time) []Train {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var trains []Train
+	for _, v := range t.hash {
+		if v.Cancelled || v.Train == nil {
+			continue
+		}
+
+		train := v.Train.WithClock(t.clock)
+		when, err := train.When()
+		if err != nil || when.Before(now) {
+			continue
+		}
+		trains = append(trains, train)
+	}
+
+	return trains
+}
+
+// ReminderSent reports if the reminder sent days before the departure was already sent in chatID
+func (t *TrainArchive) ReminderSent(train Train, chatID int64, days int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, d := range t.hash[train.UniqueID()].Reminders[chatID] {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkReminderSent records the reminder sent days before the departure in chatID
+func (t *TrainArchive) MarkReminderSent(train Train, chatID int64, days int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v, found := t.hash[train.UniqueID()]
+	if !found {
+		return
+	}
+	if v.Reminders == nil {
+		v.Reminders = make(map[int64][]int)
+	}
+	v.Reminders[chatID] = append(v.Reminders[chatID], days)
+	t.set(train.UniqueID(), v)
+}
+
+// LastDigest returns when the last digest was sent to chatID
+func (t *TrainArchive) LastDigest(chatID int64) time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.LastDigest[chatID]
+}
+
+func (t *TrainArchive) SetLastDigest(chatID int64, when time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state.LastDigest == nil {
+		t.state.LastDigest = make(map[int64]time.Time)
+	}
+	t.state.LastDigest[chatID] = when
+	t.stateDirty = true
+}
+
+// Pinned returns the pinned message of chatID
+func (t *TrainArchive) Pinned(chatID int64) (pinnedMessage, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	pinned, found := t.state.Pinned[chatID]
+	return pinned, found
+}
+
+// SetPinned saves the pinned message of chatID, a zero message removes it
+func (t *TrainArchive) SetPinned(chatID int64, pinned pinnedMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state.Pinned == nil {
+		t.state.Pinned = make(map[int64]pinnedMessage)
+	}
+	if pinned.MessageID == 0 {
+		delete(t.state.Pinned, chatID)
+	} else {
+		t.state.Pinned[chatID] = pinned
+	}
+	t.stateDirty = true
+}
+
+// IsCancelled reports if the train with the given UniqueID was cancelled
+func (t *TrainArchive) IsCancelled(id string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.hash[id].Cancelled
 }
 
 func (t *TrainArchive) IsSaved(train Train) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	_, found := t.hash[train.UniqueID()]
 	return found
 }
-func (t *TrainArchive) GetID(train Train) int {
-	return t.hash[train.UniqueID()].MessageID
+
+// GetID returns the message of the train in chatID, found is false if the train was never sent there
+func (t *TrainArchive) GetID(train Train, chatID int64) (msgID int, found bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	msgID, found = t.hash[train.UniqueID()].MessageIDs[chatID]
+	return
+}
+
+// GetIDs returns the messages of the train for each chat
+func (t *TrainArchive) GetIDs(train Train) map[int64]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ids := make(map[int64]int)
+	for chatID, msgID := range t.hash[train.UniqueID()].MessageIDs {
+		ids[chatID] = msgID
+	}
+	return ids
+}
+
+// Get returns the last saved version of the train with the given UniqueID
+func (t *TrainArchive) Get(id string) (Train, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	v, found := t.hash[id]
+	if !found || v.Train == nil {
+		return Train{}, false
+	}
+	return v.Train.WithClock(t.clock), true
+}
+
+// History returns every version of the train with the given UniqueID, the oldest first
+func (t *TrainArchive) History(id string) ([]TrainVersion, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	v, found := t.hash[id]
+	if !found {
+		return nil, false
+	}
+	history := make([]TrainVersion, len(v.History))
+	copy(history, v.History)
+	return history, true
+}
+
+// Revision returns the revision of the train with the given UniqueID
+func (t *TrainArchive) Revision(id string) (trainRevision, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	v, found := t.hash[id]
+	if !found {
+		return trainRevision{}, false
+	}
+
+	modified := v.ModifiedAt
+	if modified.IsZero() {
+		// Archived before the revisions were kept
+		modified = v.FirstSeen
+		if len(v.History) > 0 {
+			modified = v.History[len(v.History)-1].Seen
+		}
+	}
+	return trainRevision{Sequence: v.Revision, Modified: modified, Cancelled: v.Cancelled}, true
+}
+
+// Withdrawn returns the cancelled trains that were departing after now
+func (t *TrainArchive) Withdrawn(now time.Time) []Train {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var trains []Train
+	for _, v := range t.hash {
+		if !v.Cancelled || v.Train == nil {
+			continue
+		}
+
+		train := v.Train.WithClock(t.clock)
+		when, err := train.When()
+		if err != nil || when.Before(now) {
+			continue
+		}
+		trains = append(trains, train)
+	}
+
+	return trains
+}
+
+// ArchiveEntry is a version or the cancellation of a train, as recorded by the archive
+type ArchiveEntry struct {
+	Seen  time.Time
+	Train Train
+	// Version is the index of the version in the history, 0 is the announcement
+	Version   int
+	Changes   []FieldChange
+	Cancelled bool
+}
+
+// Entries returns the last limit versions and cancellations of the trains, the newest first
+func (t *TrainArchive) Entries(limit int) []ArchiveEntry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var entries []ArchiveEntry
+	for _, v := range t.hash {
+		for i, version := range v.History {
+			entries = append(entries, ArchiveEntry{
+				Seen:    version.Seen,
+				Train:   version.Train.WithClock(t.clock),
+				Version: i,
+				Changes: version.Changes,
+			})
+		}
+		if v.Cancelled && v.Train != nil {
+			entries = append(entries, ArchiveEntry{
+				Seen:      v.CancelledAt,
+				Train:     v.Train.WithClock(t.clock),
+				Version:   len(v.History),
+				Cancelled: true,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.Seen.Equal(b.Seen) {
+			return a.Seen.After(b.Seen)
+		}
+		if a.Train.UniqueID() != b.Train.UniqueID() {
+			return a.Train.UniqueID() < b.Train.UniqueID()
+		}
+		return a.Version > b.Version
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// Len returns the number of saved trains
+func (t *TrainArchive) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.hash)
 }
 
 func (t *TrainArchive) Compare(new Train) TrainArchiveCompare {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	old, found := t.hash[new.UniqueID()]
 	if !found {
 		return TrainNotSaved
 	}
-	if new.Hash() != old.TrainHash {
+	if new.Hash() != old.TrainHash || old.Cancelled {
 		return TrainChanged
 	}
 
 	return TrainSaved
 }
-
-func (t *TrainArchive) MarshalJSON() ([]byte, error) {
-	return json.Marshal(t.hash)
-}
-
-func (t *TrainArchive) UnmarshalJSON(data []byte) error {
-	return json.Unmarshal(data, &t.hash)
-}
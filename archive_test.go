@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrainArchiveMigrateMessageIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trains.hash")
+	err := os.WriteFile(path, []byte(`{
+		"legacy": {"MessageID": 12, "TrainHash": "a"},
+		"dry": {"MessageID": 0, "TrainHash": "b"},
+		"sent": {"MessageIDs": {"-1002": 5}, "TrainHash": "c"},
+		"unsent": {"TrainHash": "d"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := fixedClock(time.Date(2024, time.November, 15, 12, 0, 0, 0, timezone))
+	tests := []struct {
+		id    string
+		chat  int64
+		msgID int
+		found bool
+	}{
+		{"legacy", -1001, 12, true},
+		{"dry", -1001, 0, true},
+		{"sent", -1001, 0, false},
+		{"sent", -1002, 5, true},
+		{"unsent", -1001, 0, false},
+	}
+
+	// Migrating again after a restart must not change the records
+	for run := 0; run < 2; run++ {
+		h, err := NewTrainArchive(NewJSONFileStore(path), clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.MigrateMessageIDs(-1001)
+		for _, tt := range tests {
+			msgID, found := h.GetID(Train{Link: tt.id}, tt.chat)
+			if msgID != tt.msgID || found != tt.found {
+				t.Errorf("run %d: GetID(%s, %d) = %d, %v, want %d, %v", run, tt.id, tt.chat, msgID, found, tt.msgID, tt.found)
+			}
+		}
+		err = h.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTrainArchiveSaveLastSeen(t *testing.T) {
+	start := time.Date(2024, time.November, 15, 12, 0, 0, 0, timezone)
+	train := Train{Title: "Ferrovia dei Parchi", Link: "parchi", DateProp: "Dec 30, 2024 12:00:00 AM"}
+	tests := []struct {
+		name string
+		open func(dir string) (TrainArchiveStore, error)
+		// saved is true if the store saves a record whose only change is LastSeen
+		saved bool
+	}{
+		{
+			name: "json",
+			open: func(dir string) (TrainArchiveStore, error) {
+				return NewJSONFileStore(filepath.Join(dir, "trains.hash")), nil
+			},
+		},
+		{
+			name: "bolt",
+			open: func(dir string) (TrainArchiveStore, error) {
+				return OpenBoltStore(filepath.Join(dir, "trains.db"))
+			},
+			saved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := tt.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := NewTrainArchive(store, fixedClock(start))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Add(train, -1001, 12)
+			err = h.Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h.clock = fixedClock(start.Add(time.Hour))
+			h.Seen(train)
+			err = h.Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = h.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = tt.open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			h, err = NewTrainArchive(store, fixedClock(start))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := start
+			if tt.saved {
+				want = start.Add(time.Hour)
+			}
+			if got := h.hash[train.UniqueID()].LastSeen; !got.Equal(want) {
+				t.Errorf("LastSeen = %v, want %v", got, want)
+			}
+			if _, err := os.Stat(backupFile(filepath.Join(dir, "trains.hash"), 1)); !os.IsNotExist(err) {
+				t.Errorf("backup rotated for LastSeen only: %v", err)
+			}
+		})
+	}
+}
+
+func TestTrainArchiveMissing(t *testing.T) {
+	now := time.Date(2024, time.November, 15, 12, 0, 0, 0, timezone)
+	future := Train{Title: "Ferrovia dei Parchi", Link: "future", DateProp: "Dec 30, 2024 12:00:00 AM"}
+	past := Train{Title: "Transiberiana", Link: "past", DateProp: "Nov 1, 2024 12:00:00 AM"}
+	cancelled := Train{Title: "Porrettana", Link: "cancelled", DateProp: "Dec 8, 2024 12:00:00 AM"}
+	tests := []struct {
+		name string
+		runs int
+		// published contains the trains published in each run
+		published [][]Train
+		want      []string
+	}{
+		{name: "published", runs: 1, published: [][]Train{{future, past, cancelled}}},
+		{name: "missing", runs: 1, published: [][]Train{{}}, want: []string{"future"}},
+		{name: "missing for less runs", runs: 3, published: [][]Train{{}, {}}},
+		{name: "missing for more runs", runs: 2, published: [][]Train{{}, {}, {}}, want: []string{"future"}},
+		{name: "published again", runs: 2, published: [][]Train{{}, {future}, {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewTrainArchive(NewJSONFileStore(filepath.Join(t.TempDir(), "trains.hash")), fixedClock(now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, train := range []Train{future, past, cancelled} {
+				h.Add(train, -1001, 12)
+			}
+			h.Cancel(cancelled)
+
+			var got []Train
+			for _, published := range tt.published {
+				for _, train := range published {
+					h.Seen(train)
+				}
+				got = h.Missing(published, tt.runs)
+			}
+			var ids []string
+			for _, train := range got {
+				ids = append(ids, train.UniqueID())
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Missing() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrainArchiveSubscribersNotified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trains.hash")
+	err := os.WriteFile(path, []byte(`{
+		"legacy": {"MessageID": 12, "TrainHash": "a"},
+		"legacy-unsent": {"TrainHash": "b"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := fixedClock(time.Date(2024, time.November, 15, 12, 0, 0, 0, timezone))
+	h, err := NewTrainArchive(NewJSONFileStore(path), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.MigrateMessageIDs(-1001)
+	h.MigrateSubscribersNotified()
+	// Sent to a destination whose window is longer than the one of the subscribers
+	h.Add(Train{Link: "channel"}, -1002, 5)
+	// Sent to the subscribers before any destination
+	h.MarkSubscribersNotified(Train{Link: "subscribers"})
+	err = h.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id       string
+		notified bool
+		found    bool
+	}{
+		{"legacy", true, true},
+		{"legacy-unsent", false, false},
+		{"channel", false, false},
+		{"subscribers", true, false},
+	}
+	h, err = NewTrainArchive(NewJSONFileStore(path), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.MigrateMessageIDs(-1001)
+	h.MigrateSubscribersNotified()
+	for _, tt := range tests {
+		train := Train{Link: tt.id}
+		if got := h.SubscribersNotified(train); got != tt.notified {
+			t.Errorf("SubscribersNotified(%s) = %v, want %v", tt.id, got, tt.notified)
+		}
+		if _, found := h.GetID(train, -1001); found != tt.found {
+			t.Errorf("GetID(%s) found = %v, want %v", tt.id, found, tt.found)
+		}
+	}
+}
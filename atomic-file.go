@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// backupFile returns the name of the n-th backup of file, 1 is the newest
+func backupFile(file string, n int) string {
+	return fmt.Sprintf("%s.bak.%d", file, n)
+}
+
+// writeFileAtomic replaces file with data, readers see either the old or the new content.
+// The previous content is kept in up to backups rotating copies (see backupFile).
+func writeFileAtomic(file string, data []byte, perm os.FileMode, backups int) error {
+	dir := filepath.Dir(file)
+	tmp, err := os.CreateTemp(dir, filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write temporary file: %w", err)
+	}
+
+	if backups > 0 {
+		err = rotateBackups(file, backups)
+		if err != nil {
+			return fmt.Errorf("cannot rotate backups: %w", err)
+		}
+	}
+
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// rotateBackups shifts the backups of file by one and makes file the newest backup,
+// file itself is left in place
+func rotateBackups(file string, backups int) error {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+
+	err := os.Remove(backupFile(file, backups))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := backups - 1; n >= 1; n-- {
+		err := os.Rename(backupFile(file, n), backupFile(file, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Link instead of renaming, so file is never missing
+	err = os.Link(file, backupFile(file, 1))
+	if err != nil {
+		return copyFile(file, backupFile(file, 1))
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
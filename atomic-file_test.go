@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicRotatesBackups(t *testing.T) {
+	tests := []struct {
+		writes  int
+		backups int
+		want    map[string]string
+	}{
+		{writes: 1, backups: 3, want: map[string]string{"trains.hash": "1"}},
+		{writes: 2, backups: 3, want: map[string]string{"trains.hash": "2", "trains.hash.bak.1": "1"}},
+		{writes: 5, backups: 3, want: map[string]string{
+			"trains.hash":       "5",
+			"trains.hash.bak.1": "4",
+			"trains.hash.bak.2": "3",
+			"trains.hash.bak.3": "2",
+		}},
+		{writes: 3, backups: 0, want: map[string]string{"trains.hash": "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d writes %d backups", tt.writes, tt.backups), func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "trains.hash")
+			for i := 1; i <= tt.writes; i++ {
+				err := writeFileAtomic(file, []byte(fmt.Sprint(i)), 0644, tt.backups)
+				if err != nil {
+					t.Fatalf("writeFileAtomic() error: %v", err)
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("got %d files, want %d", len(entries), len(tt.want))
+			}
+			for name, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("cannot read %s: %v", name, err)
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TrainCatalogue is an in-memory snapshot of the trains returned by an importer, indexed by UniqueID.
+// The snapshot is refreshed explicitly with Refresh or lazily when it is older than the TTL,
+// when the importer fails the last good snapshot is kept.
+// The TTL is measured with the wall clock, the injected clock is only given to the trains.
+type TrainCatalogue struct {
+	importer TrainImporter
+	ttl      time.Duration
+	clock    Clock
+
+	mu          sync.RWMutex
+	refreshMu   sync.Mutex
+	trains      []Train
+	byID        map[string]Train
+	updatedAt   time.Time
+	nextRefresh time.Time
+	lastErr     error
+	// failures is the number of consecutive failed refreshes, lastFailure is the last one
+	failures       int
+	lastFailure    time.Time
+	lastFailureErr error
+}
+
+// CatalogueStatus describes the last refreshes of the catalogue
+type CatalogueStatus struct {
+	UpdatedAt           time.Time
+	Trains              int
+	ConsecutiveFailures int
+	LastFailure         time.Time
+	LastError           error
+}
+
+// catalogueRetryDelay is the maximum time waited before retrying a failed refresh
+const catalogueRetryDelay = time.Minute
+
+// catalogueRefreshTimeout bounds an import, the other refreshes wait for it
+const catalogueRefreshTimeout = 30 * time.Second
+
+func NewTrainCatalogue(importer TrainImporter, ttl time.Duration, clock Clock) *TrainCatalogue {
+	return &TrainCatalogue{
+		importer: importer,
+		ttl:      ttl,
+		clock:    clock,
+		byID:     make(map[string]Train),
+	}
+}
+
+// Refresh loads the trains from the importer, on failure the previous snapshot is returned with the error
+func (c *TrainCatalogue) Refresh(ctx context.Context) ([]Train, error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	return c.refresh(ctx)
+}
+
+func (c *TrainCatalogue) refresh(ctx context.Context) ([]Train, error) {
+	ctx, cancel := context.WithTimeout(ctx, catalogueRefreshTimeout)
+	defer cancel()
+
+	start := time.Now()
+	trains, err := c.importer.Trains(ctx)
+	importDuration.Observe(time.Since(start).Seconds())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr = err
+	if err != nil {
+		importFailures.Inc()
+		c.failures++
+		c.lastFailure = time.Now()
+		c.lastFailureErr = err
+		c.nextRefresh = time.Now().Add(min(c.ttl, catalogueRetryDelay))
+		return c.trains, err
+	}
+
+	byID := make(map[string]Train, len(trains))
+	for i := range trains {
+		trains[i] = trains[i].WithClock(c.clock)
+		byID[trains[i].UniqueID()] = trains[i]
+	}
+	importedTrains.Set(float64(len(trains)))
+	c.failures = 0
+	c.trains = trains
+	c.byID = byID
+	c.updatedAt = time.Now()
+	c.nextRefresh = c.updatedAt.Add(c.ttl)
+
+	return c.trains, nil
+}
+
+// Trains returns the current snapshot, refreshing it if it is stale.
+// An error is returned only if no snapshot is available.
+func (c *TrainCatalogue) Trains(ctx context.Context) ([]Train, error) {
+	c.refreshIfStale(ctx)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.updatedAt.IsZero() {
+		return nil, c.lastErr
+	}
+	return c.trains, nil
+}
+
+// Get searches the train with the given UniqueID, refreshing the snapshot if it is stale.
+func (c *TrainCatalogue) Get(ctx context.Context, id string) (Train, bool, error) {
+	c.refreshIfStale(ctx)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.updatedAt.IsZero() {
+		return Train{}, false, c.lastErr
+	}
+	train, found := c.byID[id]
+	return train, found, nil
+}
+
+// Status returns the state of the last refreshes
+func (c *TrainCatalogue) Status() CatalogueStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return CatalogueStatus{
+		UpdatedAt:           c.updatedAt,
+		Trains:              len(c.trains),
+		ConsecutiveFailures: c.failures,
+		LastFailure:         c.lastFailure,
+		LastError:           c.lastFailureErr,
+	}
+}
+
+func (c *TrainCatalogue) isStale() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Now().After(c.nextRefresh)
+}
+
+func (c *TrainCatalogue) refreshIfStale(ctx context.Context) {
+	if !c.isStale() {
+		return
+	}
+
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if !c.isStale() {
+		// Refreshed while waiting
+		return
+	}
+
+	// A client going away must not abort a refresh shared with the others
+	_, err := c.refresh(context.WithoutCancel(ctx))
+	if err != nil {
+		log.Warnln("Cannot refresh train catalogue, using last snapshot:", err)
+	}
+}
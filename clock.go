@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// Clock tells the current time, it is faked with --fake-now
+type Clock interface {
+	Now() time.Time
+}
+
+// NewClock returns the wall clock or, if fakeNow is set, a clock stopped at fakeNow
+func NewClock(fakeNow time.Time) Clock {
+	if fakeNow.IsZero() {
+		return systemClock{}
+	}
+
+	return fixedClock(fakeNow)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
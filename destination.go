@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Destination is a channel where the trains are sent
+type Destination struct {
+	Name      string
+	ChannelId int64
+	// Username of a public channel, used to link the messages
+	Username string
+	Filter   TrainFilter
+	// Trains departing after the window are not sent yet,
+	// when all are 0 the window of the Config is used
+	TrainsUntilYearsInFuture  int
+	TrainsUntilMonthsInFuture int
+	TrainsUntilDaysInFuture   int
+	// ReminderDaysBefore are the days before the departure in which a reminder is sent (ex: [7, 1])
+	ReminderDaysBefore []int
+	// DigestDays is the number of days listed in the weekly digest, 0 disables the digest
+	DigestDays int
+	// PinnedDepartures is the number of departures listed in the pinned message, 0 disables it
+	PinnedDepartures int
+}
+
+// Until returns the last time of the window starting at now
+func (d Destination) Until(now time.Time) time.Time {
+	return windowUntil(now, d.TrainsUntilYearsInFuture, d.TrainsUntilMonthsInFuture, d.TrainsUntilDaysInFuture)
+}
+
+// windowUntil returns the last time of a window of the given length starting at now,
+// math.MaxInt years disables the window
+func windowUntil(now time.Time, years int, months int, days int) time.Time {
+	if years == math.MaxInt {
+		return time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	}
+	return now.AddDate(years, months, days)
+}
+
+// Accepts reports if the train departing at when should be sent to the destination
+func (d Destination) Accepts(train Train, when time.Time, now time.Time) bool {
+	return d.Filter.Match(train) && !when.After(d.Until(now))
+}
+
+func (d Destination) String() string {
+	if d.Name == "" {
+		return fmt.Sprint(d.ChannelId)
+	}
+	return d.Name
+}
+
+// normalizeDestinations fills the destinations of the config,
+// when none is configured ChannelId is used as the only destination
+func normalizeDestinations(cfg *Config) error {
+	if len(cfg.Destinations) == 0 {
+		cfg.Destinations = []Destination{{Name: "main", ChannelId: cfg.ChannelId}}
+	}
+
+	channels := make(map[int64]bool)
+	for i := range cfg.Destinations {
+		d := &cfg.Destinations[i]
+		if channels[d.ChannelId] {
+			return fmt.Errorf("channel %d used by more than one destination", d.ChannelId)
+		}
+		channels[d.ChannelId] = true
+
+		if d.TrainsUntilYearsInFuture == 0 && d.TrainsUntilMonthsInFuture == 0 && d.TrainsUntilDaysInFuture == 0 {
+			d.TrainsUntilYearsInFuture = cfg.TrainsUntilYearsInFuture
+			d.TrainsUntilMonthsInFuture = cfg.TrainsUntilMonthsInFuture
+			d.TrainsUntilDaysInFuture = cfg.TrainsUntilDaysInFuture
+		}
+		if d.TrainsUntilYearsInFuture < 0 || d.TrainsUntilMonthsInFuture < 0 || d.TrainsUntilDaysInFuture < 0 {
+			d.TrainsUntilYearsInFuture = math.MaxInt
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type digestTrain struct {
+	Train
+	// MessageLink is the link to the message of the train in the channel, empty if sent dry
+	MessageLink string
+}
+
+type digestRegion struct {
+	Region string
+	Trains []digestTrain
+}
+
+type digestDay struct {
+	Date    time.Time
+	Regions []digestRegion
+}
+
+// parseWeekday parses the english name of a day of the week
+func parseWeekday(day string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), day) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday: %q", day)
+}
+
+// telegramMessageLink returns the link to a message of a channel, username is used for public channels
+func telegramMessageLink(chatID int64, username string, msgID int) string {
+	if username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", strings.TrimPrefix(username, "@"), msgID)
+	}
+
+	// Private channels ids are prefixed by -100
+	id := strings.TrimPrefix(fmt.Sprint(chatID), "-100")
+	return fmt.Sprintf("https://t.me/c/%s/%d", id, msgID)
+}
+
+// digestDays groups the trains sent to dest departing before until by day and region
+func digestDays(h *TrainArchive, dest Destination, now time.Time, until time.Time) []digestDay {
+	type dated struct {
+		digestTrain
+		when time.Time
+	}
+	var trains []dated
+	for _, train := range h.Upcoming(now) {
+		msgID, sent := h.GetID(train, dest.ChannelId)
+		when, err := train.When()
+		if !sent || err != nil || when.After(until) {
+			continue
+		}
+
+		t := dated{digestTrain{Train: train}, when}
+		if msgID != 0 {
+			t.MessageLink = telegramMessageLink(dest.ChannelId, dest.Username, msgID)
+		}
+		trains = append(trains, t)
+	}
+	sort.Slice(trains, func(i, j int) bool {
+		if !trains[i].when.Equal(trains[j].when) {
+			return trains[i].when.Before(trains[j].when)
+		}
+		return trains[i].Region < trains[j].Region
+	})
+
+	var days []digestDay
+	for _, t := range trains {
+		y, m, d := t.when.In(timezone).Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, timezone)
+		if len(days) == 0 || !days[len(days)-1].Date.Equal(date) {
+			days = append(days, digestDay{Date: date})
+		}
+
+		day := &days[len(days)-1]
+		var region *digestRegion
+		for i := range day.Regions {
+			if day.Regions[i].Region == t.Region {
+				region = &day.Regions[i]
+			}
+		}
+		if region == nil {
+			day.Regions = append(day.Regions, digestRegion{Region: t.Region})
+			region = &day.Regions[len(day.Regions)-1]
+		}
+		region.Trains = append(region.Trains, t.digestTrain)
+	}
+
+	for i := range days {
+		sort.SliceStable(days[i].Regions, func(a, b int) bool { return days[i].Regions[a].Region < days[i].Regions[b].Region })
+	}
+
+	return days
+}
+
+// sendDigests sends the digest to the destinations with DigestDays,
+// once on the configured day after the configured hour
+func sendDigests(bot *TelegramBot, h *TrainArchive, now time.Time) {
+	weekday, err := parseWeekday(bot.DigestWeekday)
+	if err != nil {
+		log.Errorln("Cannot send digest:", err)
+		return
+	}
+	local := now.In(timezone)
+	if local.Weekday() != weekday || local.Hour() < bot.DigestHour {
+		return
+	}
+
+	for _, dest := range bot.Destinations {
+		if dest.DigestDays <= 0 {
+			continue
+		}
+		if last := h.LastDigest(dest.ChannelId); now.Sub(last) < 24*time.Hour {
+			log.Debugln("Digest already sent:", dest, last)
+			continue
+		}
+
+		days := digestDays(h, dest, now, now.AddDate(0, 0, dest.DigestDays))
+		if len(days) == 0 {
+			log.Infoln("No trains for the digest:", dest)
+		} else {
+			log.Infoln("Sending digest:", dest)
+			err := bot.SendDigest(dest.ChannelId, dest.DigestDays, days)
+			if err != nil {
+				log.Errorln("Cannot send digest:", dest, err)
+				continue
+			}
+		}
+		h.SetLastDigest(dest.ChannelId, now)
+	}
+}
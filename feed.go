@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// feedMaxEntries is the number of entries in the atom and rss feeds
+const feedMaxEntries = 50
+
+const feedTitle = "Treni storici"
+
+// blankLines matches the empty lines left by the template for the missing fields
+var blankLines = regexp.MustCompile(`\n\s*\n(\s*\n)+`)
+
+// feedEntry is an entry of the feeds, shared by atom and rss
+type feedEntry struct {
+	ID       string
+	Title    string
+	Link     string
+	Body     string
+	Updated  time.Time
+	ImageURL string
+}
+
+// feedEntries renders the last entries of the archive
+func (s *HttpServer) feedEntries() ([]feedEntry, error) {
+	var entries []feedEntry
+	for _, e := range s.archive.Entries(feedMaxEntries) {
+		body := &bytes.Buffer{}
+		title := e.Train.Title
+		suffix := fmt.Sprintf("v%d", e.Version)
+		switch {
+		case e.Cancelled:
+			title = "Annullato: " + title
+			suffix = "cancelled"
+		case e.Version > 0:
+			title = "Aggiornato: " + title
+			writeFeedChanges(body, e.Changes)
+		}
+
+		err := calendarTemplate.Execute(body, e.Train)
+		if err != nil {
+			return nil, fmt.Errorf("cannot execute template: %w", err)
+		}
+
+		entry := feedEntry{
+			ID:      s.feedEntryID(e.Train, suffix),
+			Title:   title,
+			Link:    BaseURL + strings.TrimPrefix(e.Train.Link, "/"),
+			Body:    strings.TrimSpace(blankLines.ReplaceAllString(body.String(), "\n\n")),
+			Updated: e.Seen,
+		}
+		if ok, link := httpAddressForTrain(e.Train, s.HttpPublicAddress, "/html/"); ok && s.HttpPublicAddress != "" {
+			entry.Link = link
+		}
+		if e.Train.ImageURL != "" {
+			entry.ImageURL = BaseURL + strings.TrimPrefix(e.Train.ImageURL, "/")
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// writeFeedChanges writes the changes announced in the replies on telegram
+func writeFeedChanges(w *bytes.Buffer, changes []FieldChange) {
+	for _, field := range changeReplyFields {
+		for _, change := range changes {
+			if change.Field == field.Field {
+				fmt.Fprintf(w, "%s: %s\n", field.Label, feedChange(change))
+			}
+		}
+	}
+	if w.Len() > 0 {
+		w.WriteString("\n")
+	}
+}
+
+func feedChange(c FieldChange) string {
+	switch {
+	case c.Old == "":
+		return c.New
+	case c.New == "":
+		return c.Old + " rimosso"
+	default:
+		return c.Old + " → " + c.New
+	}
+}
+
+// feedEntryID is the id of an entry, suffix distinguishes the versions of the train.
+// The ids are tag uris (RFC 4151), the date must never change.
+func (s *HttpServer) feedEntryID(train Train, suffix string) string {
+	return fmt.Sprintf("tag:%s,2022:%s#%s", s.publicHostname(), train.UniqueID(), suffix)
+}
+
+// imageType guesses the mime type of the image from its extension
+func imageType(url string) string {
+	t := mime.TypeByExtension(strings.ToLower(path.Ext(url)))
+	if t == "" {
+		return "image/jpeg"
+	}
+	return t
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int    `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func (s *HttpServer) handleFeedAtom(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.feedEntries()
+	if err != nil {
+		log.Errorln("Cannot create feed:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	feed := atomFeed{
+		ID:    fmt.Sprintf("tag:%s,2022:feed", s.publicHostname()),
+		Title: feedTitle,
+		Links: []atomLink{
+			{Href: s.HttpPublicAddress + "/feed.atom", Rel: "self", Type: "application/atom+xml"},
+			{Href: BaseURL},
+		},
+		Updated: s.clock.Now().Format(time.RFC3339),
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].Updated.Format(time.RFC3339)
+	}
+	for _, e := range entries {
+		entry := atomEntry{
+			ID:      e.ID,
+			Title:   e.Title,
+			Updated: e.Updated.Format(time.RFC3339),
+			Links:   []atomLink{{Href: e.Link, Rel: "alternate"}},
+			Content: atomContent{Type: "text", Body: e.Body},
+		}
+		if e.ImageURL != "" {
+			entry.Links = append(entry.Links, atomLink{Href: e.ImageURL, Rel: "enclosure", Type: imageType(e.ImageURL)})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	writeXML(w, r, "application/atom+xml", feed)
+}
+
+func (s *HttpServer) handleFeedRSS(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.feedEntries()
+	if err != nil {
+		log.Errorln("Cannot create feed:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       feedTitle,
+		Link:        BaseURL,
+		Description: "I treni storici di Fondazione FS",
+	}}
+	if len(entries) > 0 {
+		feed.Channel.LastBuildDate = entries[0].Updated.Format(time.RFC1123Z)
+	}
+	for _, e := range entries {
+		item := rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			Description: e.Body,
+			GUID:        rssGUID{ID: e.ID},
+			PubDate:     e.Updated.Format(time.RFC1123Z),
+		}
+		if e.ImageURL != "" {
+			item.Enclosure = &rssEnclosure{URL: e.ImageURL, Type: imageType(e.ImageURL)}
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	writeXML(w, r, "application/rss+xml", feed)
+}
+
+func writeXML(w http.ResponseWriter, r *http.Request, contentType string, v any) {
+	body, err := xml.MarshalIndent(v, "", "\t")
+	if err != nil {
+		log.Errorln("Cannot encode feed:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeWithETag(w, r, contentType+"; charset=utf-8", append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TrainFilter selects trains, empty fields match every train
+type TrainFilter struct {
+	// Regions matches the region of the train, ignoring case
+	Regions []string `json:",omitempty"`
+	// Locomotives matches if the locomotive of the train contains one of them, ignoring case (ex: "vapore")
+	Locomotives []string `json:",omitempty"`
+	// Timeless selects only the trains on "binari senza tempo" if true, excludes them if false
+	Timeless *bool `json:",omitempty"`
+	// MinPrice and MaxPrice select the trains by adult price, 0 means no limit.
+	// Trains without a price don't match a price range.
+	MinPrice float64 `json:",omitempty"`
+	MaxPrice float64 `json:",omitempty"`
+}
+
+func (f TrainFilter) Match(train Train) bool {
+	if len(f.Regions) > 0 && !containsFold(f.Regions, train.Region) {
+		return false
+	}
+
+	if len(f.Locomotives) > 0 {
+		found := false
+		locomotive := strings.ToLower(train.Locomotive)
+		for _, l := range f.Locomotives {
+			if strings.Contains(locomotive, strings.ToLower(l)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.Timeless != nil && *f.Timeless != train.IsTimeless {
+		return false
+	}
+
+	if f.MinPrice > 0 || f.MaxPrice > 0 {
+		price, ok := train.Price()
+		if !ok || price < f.MinPrice || (f.MaxPrice > 0 && price > f.MaxPrice) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsFold reports if list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(strings.TrimSpace(l), strings.TrimSpace(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrice parses a price as written on the website (ex: "25", "12,50", "12.50 €")
+func parsePrice(price string) (float64, bool) {
+	price = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(price), "€"))
+	price = strings.ReplaceAll(price, ",", ".")
+	if price == "" {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(price, 64)
+	return value, err == nil
+}
+
+// filterFromQuery creates a filter from the parameters of a request:
+// region and locomotive can be repeated or comma separated, timeless is 1 or 0
+func filterFromQuery(query url.Values) (TrainFilter, error) {
+	var f TrainFilter
+	f.Regions = queryList(query["region"])
+	f.Locomotives = queryList(query["locomotive"])
+
+	if timeless := query.Get("timeless"); timeless != "" {
+		value, err := strconv.ParseBool(timeless)
+		if err != nil {
+			return f, fmt.Errorf("invalid timeless: %q", timeless)
+		}
+		f.Timeless = &value
+	}
+
+	return f, nil
+}
+
+// queryList splits comma separated values, ignoring empty ones
+func queryList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+)
+
+// FieldChange is a field that differs between two versions of a train
+type FieldChange struct {
+	Field string
+	Old   string `json:",omitempty"`
+	New   string `json:",omitempty"`
+}
+
+func (c FieldChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%s added: %s", c.Field, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%s removed, was: %s", c.Field, c.Old)
+	default:
+		return fmt.Sprintf("%s %s → %s", c.Field, c.Old, c.New)
+	}
+}
+
+// TrainVersion is a version of a train observed by the bot,
+// Changes is the difference from the previous version
+type TrainVersion struct {
+	Seen    time.Time
+	Train   Train
+	Changes []FieldChange `json:",omitempty"`
+}
+
+// DiffTrains compares every exported field of the trains
+func DiffTrains(old, new Train) []FieldChange {
+	var changes []FieldChange
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(new)
+	trainType := oldValue.Type()
+
+	for i := 0; i < trainType.NumField(); i++ {
+		field := trainType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		o := fmt.Sprint(oldValue.Field(i).Interface())
+		n := fmt.Sprint(newValue.Field(i).Interface())
+		if o != n {
+			changes = append(changes, FieldChange{Field: field.Name, Old: o, New: n})
+		}
+	}
+
+	return changes
+}
+
+// writeTrainHistory prints the history of the train in a human readable format
+func writeTrainHistory(w io.Writer, history []TrainVersion) {
+	for i, version := range history {
+		seen := version.Seen.In(timezone).Format("2006-01-02 15:04")
+		if i == 0 {
+			fmt.Fprintf(w, "%s  first seen: %s\n", seen, version.Train)
+			continue
+		}
+
+		if len(version.Changes) == 0 {
+			fmt.Fprintf(w, "%s  no changes\n", seen)
+		}
+		for _, change := range version.Changes {
+			fmt.Fprintf(w, "%s  %s\n", seen, change)
+		}
+	}
+}
+
+// trainHistoryLookup returns the history of the train with the given UniqueID
+type trainHistoryLookup func(id string) (history []TrainVersion, found bool, err error)
+
+// historyCommand prints the history of the trains with the given UniqueIDs, returns the exit code
+func historyCommand(cfg Config, clock Clock, ids []string) int {
+	if len(ids) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: fondazionefs-news history <train id>...")
+		return 2
+	}
+
+	lookup, err := openTrainHistory(cfg, clock)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read the train archive:", err)
+		return 1
+	}
+
+	code := 0
+	for _, id := range ids {
+		history, found, err := lookup(id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read the history of the train:", id, err)
+			code = 1
+			continue
+		}
+		if !found {
+			fmt.Fprintln(os.Stderr, "Cannot find train:", id)
+			code = 1
+			continue
+		}
+
+		fmt.Println(id)
+		writeTrainHistory(os.Stdout, history)
+	}
+
+	return code
+}
+
+// openTrainHistory reads the archive without modifying it,
+// when the running bot holds the database the history is asked to its http server
+func openTrainHistory(cfg Config, clock Clock) (trainHistoryLookup, error) {
+	store, err := OpenTrainArchiveStoreReadOnly(cfg)
+	if errors.Is(err, errArchiveLocked) && cfg.HttpListenAddress != "" {
+		return httpTrainHistory(cfg.HttpListenAddress), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	h, err := NewTrainArchive(store, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(id string) ([]TrainVersion, bool, error) {
+		history, found := h.History(id)
+		return history, found, nil
+	}, nil
+}
+
+// httpTrainHistory fetches the history from /history/ of the bot listening on listenAddress
+func httpTrainHistory(listenAddress string) trainHistoryLookup {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		host, port = listenAddress, "80"
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+	base := "http://" + net.JoinHostPort(host, port) + "/history/"
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return func(id string) ([]TrainVersion, bool, error) {
+		res, err := client.Get(base + url.PathEscape(id))
+		if err != nil {
+			return nil, false, fmt.Errorf("the archive is in use and the bot cannot be reached: %w", err)
+		}
+		defer res.Body.Close()
+
+		switch res.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return nil, false, nil
+		default:
+			return nil, false, fmt.Errorf("the bot answered %s", res.Status)
+		}
+
+		var history []TrainVersion
+		err = json.NewDecoder(res.Body).Decode(&history)
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot decode the history: %w", err)
+		}
+		return history, true, nil
+	}
+}
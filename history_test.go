@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffTrains(t *testing.T) {
+	base := Train{
+		Title:         "Ferrovia dei Parchi",
+		MonthDay:      "30/12",
+		DepartureTime: "8:15",
+		PriceAdult:    "30 €",
+		IsTimeless:    true,
+	}
+	tests := []struct {
+		name   string
+		change func(t *Train)
+		want   []FieldChange
+	}{
+		{
+			name:   "unchanged",
+			change: func(t *Train) {},
+		},
+		{
+			name:   "changed",
+			change: func(t *Train) { t.DepartureTime = "9:15" },
+			want:   []FieldChange{{Field: "DepartureTime", Old: "8:15", New: "9:15"}},
+		},
+		{
+			name:   "added",
+			change: func(t *Train) { t.ArriveStation = "Castel di Sangro" },
+			want:   []FieldChange{{Field: "ArriveStation", New: "Castel di Sangro"}},
+		},
+		{
+			name:   "removed",
+			change: func(t *Train) { t.PriceAdult = "" },
+			want:   []FieldChange{{Field: "PriceAdult", Old: "30 €"}},
+		},
+		{
+			name: "more fields in declaration order",
+			change: func(t *Train) {
+				t.PriceAdult = "35 €"
+				t.MonthDay = "31/12"
+				t.IsTimeless = false
+			},
+			want: []FieldChange{
+				{Field: "MonthDay", Old: "30/12", New: "31/12"},
+				{Field: "IsTimeless", Old: "true", New: "false"},
+				{Field: "PriceAdult", Old: "30 €", New: "35 €"},
+			},
+		},
+		{
+			name:   "clock is ignored",
+			change: func(t *Train) { *t = t.WithClock(systemClock{}) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := base
+			tt.change(&changed)
+			got := DiffTrains(base, changed)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffTrains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
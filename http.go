@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	htmltemplate "html/template"
 	"net/http"
 	"strings"
 	"text/template"
 
-	ics "github.com/arran4/golang-ical"
 	"github.com/goodsign/monday"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -18,154 +20,229 @@ import (
 //go:embed calendar.tmpl
 var calendarTemplateSource string
 
+//go:embed site.html.tmpl
+var siteHtmlTemplateSource string
+
 //go:embed calendar.html.tmpl
 var calendarHtmlTemplateSource string
 
+//go:embed index.html.tmpl
+var indexHtmlTemplateSource string
+
 var calendarTemplate = template.Must(template.New("calendar").Parse(calendarTemplateSource))
-var calendarHtmlTemplate = htmltemplate.Must(htmltemplate.New("calendar.html").Parse(calendarHtmlTemplateSource))
+
+// siteTemplate contains the pages of the site, site.html.tmpl has the parts shared by them
+var siteTemplate = htmltemplate.Must(htmltemplate.New("site").Parse(siteHtmlTemplateSource))
+var calendarHtmlTemplate = htmltemplate.Must(siteTemplate.New("calendar.html").Parse(calendarHtmlTemplateSource))
+var indexHtmlTemplate = htmltemplate.Must(siteTemplate.New("index.html").Parse(indexHtmlTemplateSource))
 
 // Used instead of string.Title
 var titler = cases.Title(language.Italian)
 
-func startAndListenHttpServer(addr string, baseURL string) {
-	http.HandleFunc("/ics/", httpHandleTrainCreateICal)
-	http.HandleFunc("/html/", httpHandleTrainIcalHtml(baseURL))
-	log.Println("Listening on: " + addr)
-	http.ListenAndServe(addr, nil)
+// HttpServer serves the calendar of the trains, trains no longer published
+// by Fondazione FS are served from the archive
+type HttpServer struct {
+	Config
+	clock Clock
+
+	catalogue *TrainCatalogue
+	archive   *TrainArchive
+	status    *BotStatus
+	server    *http.Server
 }
 
-func httpICalAddressForTrain(t Train, baseUrl string) (ok bool, url string) {
-	ok = false
-	url = ""
-	ok, _, _ = t.DepartureArriveTime()
-	if !ok {
-		return
+func NewHttpServer(cfg Config, clock Clock, catalogue *TrainCatalogue, archive *TrainArchive, status *BotStatus) *HttpServer {
+	s := &HttpServer{
+		Config:    cfg,
+		clock:     clock,
+		catalogue: catalogue,
+		archive:   archive,
+		status:    status,
 	}
+	s.server = &http.Server{Addr: cfg.HttpListenAddress, Handler: s.Handler()}
+	return s
+}
 
-	url = baseUrl + "/ics/" + t.UniqueID()
-	return
+// ListenAndServe serves the requests until Shutdown is called, returning http.ErrServerClosed
+func (s *HttpServer) ListenAndServe() error {
+	log.Println("Listening on: " + s.HttpListenAddress)
+	return s.server.ListenAndServe()
 }
 
-func httpHtmlAddressForTrain(t Train, baseUrl string) (ok bool, url string) {
-	ok = false
-	url = ""
-	ok, _, _ = t.DepartureArriveTime()
-	if !ok {
-		return
-	}
+// Shutdown stops accepting requests and waits for the active ones to complete until ctx is done
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
 
-	url = baseUrl + "/html/" + t.UniqueID()
-	return
+// Handler returns the handler of every page served
+func (s *HttpServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, name string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrumentHandler(name, h))
+	}
+	handle("GET /{$}", "index", s.handleIndex)
+	handle("/ics/", "ics", s.handleTrainCreateICal)
+	handle("/ics/feed.ics", "ics-feed", s.handleFeedICal)
+	handle("/html/", "html", s.handleTrainIcalHtml)
+	handle("/history/", "history", s.handleTrainHistory)
+	handle("/feed.atom", "atom", s.handleFeedAtom)
+	handle("/feed.rss", "rss", s.handleFeedRSS)
+	handle("GET /api/v1/trains", "api-trains", s.handleApiTrains)
+	handle("GET /api/v1/trains/{id...}", "api-train", s.handleApiTrain)
+	handle("GET /api/v1/regions", "api-regions", s.handleApiRegions)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/status", s.handleStatus)
+	return mux
 }
 
-func httpHandleTrainIcalHtml(baseURL string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		trainID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/html/"), ".html")
-		trains, err := LoadTrains()
-		if err != nil {
-			log.Errorln("Cannot load trains:", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		var train Train
-		for _, t := range trains {
-			if trainID == t.UniqueID() {
-				train = t
-				break
+type trainStatus int
+
+const (
+	// trainScheduled is a train published by Fondazione FS
+	trainScheduled trainStatus = iota
+	// trainPast is a train that already departed
+	trainPast
+	// trainRemoved is a train no longer published by Fondazione FS
+	trainRemoved
+	// trainCancelled is a train that disappeared before departing
+	trainCancelled
+)
+
+var errTrainNotFound = errors.New("train not found")
+
+// findTrain searches the train in the catalogue, falling back to the archive
+func (s *HttpServer) findTrain(ctx context.Context, id string) (Train, trainStatus, error) {
+	status := trainScheduled
+	train, found, err := s.catalogue.Get(ctx, id)
+	if err != nil {
+		log.Warnln("Cannot load trains, searching in the archive:", err)
+	}
+
+	if !found {
+		train, found = s.archive.Get(id)
+		if !found {
+			if err != nil {
+				return Train{}, status, err
 			}
+			return Train{}, status, errTrainNotFound
 		}
 
-		if train.Link == "" {
-			// Cannot find the train
-			log.Errorln("Cannot find train:", trainID)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+		if err == nil {
+			// The catalogue is loaded and the train is missing
+			status = trainRemoved
 		}
+	}
 
-		when, err := train.When()
-		if err != nil {
-			log.Errorln("Cannot get train date: ", trainID, err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		_, icalURL := httpICalAddressForTrain(train, baseURL)
-		err = calendarHtmlTemplate.ExecuteTemplate(w, "calendar.html", struct {
-			Train
-			ICalURL       string
-			FormattedDate string
-		}{train, icalURL, titler.String(monday.Format(when, "Monday 2 January 2006, 15:04", monday.LocaleItIT))})
-		if err != nil {
-			log.Errorln(err)
-		}
+	when, err := train.When()
+	if s.archive.IsCancelled(id) {
+		status = trainCancelled
+	} else if err == nil && when.Before(s.clock.Now()) {
+		status = trainPast
 	}
+
+	return train, status, nil
 }
 
-func httpHandleTrainCreateICal(w http.ResponseWriter, r *http.Request) {
-	hostname := r.Host // Not the best way, but it shouldn't be a problem
+// httpFindTrainError writes the response for an error returned by findTrain
+func httpFindTrainError(w http.ResponseWriter, trainID string, err error) {
+	if errors.Is(err, errTrainNotFound) {
+		log.Warnln("Cannot find train:", trainID)
+		http.Error(w, "Train not found", http.StatusNotFound)
+		return
+	}
 
-	trainID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/ics/"), ".ics")
-	trains, err := LoadTrains()
-	if err != nil {
-		log.Errorln("Cannot load trains:", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	log.Errorln("Cannot load trains:", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// handleTrainHistory returns every version of an archived train as json
+func (s *HttpServer) handleTrainHistory(w http.ResponseWriter, r *http.Request) {
+	trainID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/history/"), ".json")
+	history, found := s.archive.History(trainID)
+	if !found {
+		httpFindTrainError(w, trainID, errTrainNotFound)
 		return
 	}
-	var train Train
-	for _, t := range trains {
-		if trainID == t.UniqueID() {
-			train = t
-			break
-		}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(history)
+	if err != nil {
+		log.Errorln("Cannot encode train history:", err)
 	}
+}
 
-	if train.Link == "" {
-		// Cannot find the train
-		log.Errorln("Cannot find train:", trainID)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+// httpAddressForTrain returns the address of the train under prefix (ex: "/ics/"), ok is false if the train has no date
+func httpAddressForTrain(t Train, baseUrl string, prefix string) (ok bool, url string) {
+	if _, err := t.When(); err != nil {
+		return false, ""
+	}
+
+	return true, baseUrl + prefix + t.UniqueID()
+}
+
+func (s *HttpServer) handleTrainIcalHtml(w http.ResponseWriter, r *http.Request) {
+	trainID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/html/"), ".html")
+	train, status, err := s.findTrain(r.Context(), trainID)
+	if err != nil {
+		httpFindTrainError(w, trainID, err)
 		return
 	}
 
-	ok, outboundDeparture, outboundArrive := train.DepartureArriveTime()
-	if !ok {
-		log.Errorln("Cannot retrieve train outbound time:", train, r.Form.Get("train"))
+	when, err := train.When()
+	if err != nil {
+		log.Errorln("Cannot get train date: ", trainID, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	dateFormat := "Monday 2 January 2006, 15:04"
+	if strings.TrimSpace(train.DepartureTime) == "" {
+		dateFormat = "Monday 2 January 2006"
+	}
+	// Trains without times are added as all-day events
+	_, icalURL := httpAddressForTrain(train, s.HttpPublicAddress, "/ics/")
+	image := ""
+	if train.ImageURL != "" {
+		image = BaseURL + strings.TrimPrefix(train.ImageURL, "/")
+	}
+	err = calendarHtmlTemplate.Execute(w, struct {
+		Train
+		ICalURL       string
+		InfoURL       string
+		MapURL        string
+		Image         string
+		FormattedDate string
+		Past          bool
+		Removed       bool
+		Cancelled     bool
+	}{
+		train, icalURL,
+		BaseURL + strings.TrimPrefix(train.Link, "/"),
+		stationMapURL(train.DepartureStation),
+		image,
+		titler.String(monday.Format(when, dateFormat, monday.LocaleItIT)),
+		status == trainPast, status == trainRemoved, status == trainCancelled,
+	})
+	if err != nil {
+		log.Errorln(err)
+	}
+}
 
-	hasReturn, returnDeparture, returnArrive := train.ReturnDepartureArriveTime()
-
-	var description bytes.Buffer
-	err = calendarTemplate.Execute(&description, train)
+func (s *HttpServer) handleTrainCreateICal(w http.ResponseWriter, r *http.Request) {
+	trainID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/ics/"), ".ics")
+	train, _, err := s.findTrain(r.Context(), trainID)
 	if err != nil {
-		log.Errorln("Cannot execute template:", r.Form.Get("train"), ":", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		httpFindTrainError(w, trainID, err)
 		return
 	}
 
-	cal := ics.NewCalendar()
-	cal.SetMethod(ics.MethodPublish)
-
-	cal.SetName(train.Title)
-	cal.SetTzid("Europe/Rome")
-	ev := cal.AddEvent(train.Hash() + "@trenistorici" + hostname)
-
-	ev.SetSummary(train.String())
-	ev.SetURL(BaseURL + strings.TrimPrefix(train.Link, "/"))
-	ev.SetLocation("Stazione di " + train.DepartureStation)
-	ev.SetDescription(description.String())
-	ev.SetStartAt(outboundDeparture)
-	ev.SetEndAt(outboundArrive)
-	ev.SetClass(ics.ClassificationPublic)
-
-	if hasReturn {
-		ret := cal.AddEvent(train.Hash() + "-return" + "@trenistorici" + hostname)
-		ret.SetSummary(train.String())
-		ret.SetURL(BaseURL + strings.TrimPrefix(train.Link, "/"))
-		ret.SetLocation("Stazione di " + train.ArriveStation)
-		ret.SetDescription(description.String())
-		ret.SetStartAt(returnDeparture)
-		ret.SetEndAt(returnArrive)
-		ret.SetClass(ics.ClassificationPublic)
+	cal := newCalendar(train.Title)
+	err = s.addTrainEvents(cal, train)
+	if err != nil {
+		log.Errorln("Cannot create train events:", trainID, ":", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Add("Content-Type", "text/calendar")
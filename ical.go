@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	ics "github.com/arran4/golang-ical"
+	log "github.com/sirupsen/logrus"
+)
+
+// calendarTimezone is the VTIMEZONE of Europe/Rome, the times of the events refer to it
+var calendarTimezone = &ics.VTimezone{ComponentBase: ics.ComponentBase{
+	Properties: []ics.IANAProperty{
+		{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzid), Value: "Europe/Rome"}},
+	},
+	Components: []ics.Component{
+		&ics.Daylight{ComponentBase: ics.ComponentBase{Properties: []ics.IANAProperty{
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzoffsetfrom), Value: "+0100"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzoffsetto), Value: "+0200"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzname), Value: "CEST"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyDtstart), Value: "19700329T020000"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyRrule), Value: "FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU"}},
+		}}},
+		&ics.Standard{ComponentBase: ics.ComponentBase{Properties: []ics.IANAProperty{
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzoffsetfrom), Value: "+0200"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzoffsetto), Value: "+0100"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyTzname), Value: "CET"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyDtstart), Value: "19701025T030000"}},
+			{BaseProperty: ics.BaseProperty{IANAToken: string(ics.PropertyRrule), Value: "FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU"}},
+		}}},
+	},
+}}
+
+// newCalendar creates a calendar with the Europe/Rome timezone
+func newCalendar(name string) *ics.Calendar {
+	cal := ics.NewCalendar()
+	cal.SetMethod(ics.MethodPublish)
+	cal.SetName(name)
+	cal.SetXWRCalName(name)
+	cal.SetXWRTimezone("Europe/Rome")
+	cal.Components = append(cal.Components, calendarTimezone)
+	return cal
+}
+
+// addTrainEvents adds the events of the outbound and return train to cal,
+// their uid are derived from the UniqueID of the train so that updates replace the old events.
+// Trains without times become all-day events.
+func (s *HttpServer) addTrainEvents(cal *ics.Calendar, train Train) error {
+	var description bytes.Buffer
+	err := calendarTemplate.Execute(&description, train)
+	if err != nil {
+		return fmt.Errorf("cannot execute template: %w", err)
+	}
+
+	id, domain := train.UniqueID(), s.publicHostname()
+	rev := s.trainRevision(train)
+
+	ev := s.newTrainEvent(cal, id+"@"+domain, train, train.DepartureStation, description.String(), rev)
+	ok, outboundDeparture, outboundArrive := train.DepartureArriveTime()
+	if !ok {
+		date, err := train.When()
+		if err != nil {
+			return err
+		}
+		setEventDay(ev, date)
+		return nil
+	}
+	setEventTime(ev, ics.ComponentPropertyDtStart, outboundDeparture)
+	setEventTime(ev, ics.ComponentPropertyDtEnd, outboundArrive)
+
+	hasReturn, returnDeparture, returnArrive := train.ReturnDepartureArriveTime()
+	if hasReturn {
+		ret := s.newTrainEvent(cal, id+"-return@"+domain, train, train.ArriveStation, description.String(), rev)
+		setEventTime(ret, ics.ComponentPropertyDtStart, returnDeparture)
+		setEventTime(ret, ics.ComponentPropertyDtEnd, returnArrive)
+	}
+
+	return nil
+}
+
+// newTrainEvent adds to cal an event of the train departing from station
+func (s *HttpServer) newTrainEvent(cal *ics.Calendar, id string, train Train, station string, description string, rev trainRevision) *ics.VEvent {
+	ev := cal.AddEvent(id)
+	ev.SetSummary(train.String())
+	ev.SetURL(BaseURL + strings.TrimPrefix(train.Link, "/"))
+	ev.SetLocation("Stazione di " + station)
+	if coord, found := stationCoordinates(station); found {
+		ev.SetGeo(coord.Lat, coord.Lon)
+	}
+	ev.SetDescription(description)
+	ev.SetClass(ics.ClassificationPublic)
+	setEventRevision(ev, rev)
+
+	for _, hours := range s.CalendarAlarmsHoursBefore {
+		alarm := ev.AddAlarm()
+		alarm.SetAction(ics.ActionDisplay)
+		alarm.SetTrigger(fmt.Sprintf("-PT%dH", hours))
+		alarm.SetProperty(ics.ComponentPropertyDescription, train.String())
+	}
+
+	return ev
+}
+
+// setEventTime sets a time of the event in the Europe/Rome timezone
+func setEventTime(ev *ics.VEvent, property ics.ComponentProperty, t time.Time) {
+	ev.SetProperty(property, t.In(timezone).Format("20060102T150405"),
+		&ics.KeyValues{Key: string(ics.ParameterTzid), Value: []string{"Europe/Rome"}})
+}
+
+// setEventDay makes the event last the whole day of date
+func setEventDay(ev *ics.VEvent, date time.Time) {
+	date = date.In(timezone)
+	ev.SetProperty(ics.ComponentPropertyDtStart, date.Format("20060102"), ics.WithValue(string(ics.ValueDataTypeDate)))
+	ev.SetProperty(ics.ComponentPropertyDtEnd, date.AddDate(0, 0, 1).Format("20060102"), ics.WithValue(string(ics.ValueDataTypeDate)))
+}
+
+// setEventRevision sets the sequence of the event and marks it as cancelled
+func setEventRevision(ev *ics.VEvent, rev trainRevision) {
+	ev.SetSequence(rev.Sequence)
+	ev.SetDtStampTime(rev.Modified)
+	ev.SetModifiedAt(rev.Modified)
+	if rev.Cancelled {
+		ev.SetStatus(ics.ObjectStatusCancelled)
+	} else {
+		ev.SetStatus(ics.ObjectStatusConfirmed)
+	}
+}
+
+// trainRevision returns the revision of the train from the archive,
+// trains never archived are at their first revision
+func (s *HttpServer) trainRevision(train Train) trainRevision {
+	rev, found := s.archive.Revision(train.UniqueID())
+	if !found || rev.Modified.IsZero() {
+		rev.Modified = s.clock.Now()
+	}
+	return rev
+}
+
+// publicHostname returns the hostname of HttpPublicAddress, used in the uid of the events
+func (s *HttpServer) publicHostname() string {
+	u, err := url.Parse(s.HttpPublicAddress)
+	if err != nil || u.Hostname() == "" {
+		return "trenistorici"
+	}
+	return u.Hostname()
+}
+
+// handleFeedICal returns every upcoming train as a subscribable calendar,
+// the trains can be filtered with the query (see filterFromQuery)
+func (s *HttpServer) handleFeedICal(w http.ResponseWriter, r *http.Request) {
+	trains, err := s.catalogue.Trains(r.Context())
+	if err != nil {
+		log.Errorln("Cannot load trains:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	filter, err := filterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := s.clock.Now()
+	published := make(map[string]bool, len(trains))
+	var upcoming []Train
+	for _, train := range trains {
+		published[train.UniqueID()] = true
+		when, err := train.When()
+		if err != nil || when.Before(now) || !filter.Match(train) {
+			continue
+		}
+		upcoming = append(upcoming, train)
+	}
+	// Keep the withdrawn trains, so that the calendars remove them
+	for _, train := range s.archive.Withdrawn(now) {
+		if !published[train.UniqueID()] && filter.Match(train) {
+			upcoming = append(upcoming, train)
+		}
+	}
+	sort.Slice(upcoming, func(i, j int) bool { return upcoming[i].UniqueID() < upcoming[j].UniqueID() })
+
+	cal := newCalendar("Treni storici")
+	cal.SetXWRCalDesc("I treni storici di Fondazione FS")
+	cal.SetRefreshInterval("PT1H")
+	cal.SetXPublishedTTL("PT1H")
+
+	for _, train := range upcoming {
+		err := s.addTrainEvents(cal, train)
+		if err != nil {
+			log.Debugln("Skipping train in calendar feed:", train, err)
+		}
+	}
+
+	w.Header().Add("Content-Type", "text/calendar")
+	err = cal.SerializeTo(w)
+	if err != nil {
+		log.Errorln("Cannot encode calendar:", err)
+	}
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,11 +20,25 @@ import (
 type Config struct {
 	TelegramBotToken          string
 	ChannelId                 int64
+	Destinations              []Destination
 	HttpPublicAddress         string
 	HttpListenAddress         string
 	TrainsUntilYearsInFuture  int
 	TrainsUntilMonthsInFuture int
 	TrainsUntilDaysInFuture   int
+	TrainsCacheMinutes        int
+	ArchiveDatabase           string
+	ReplyOnChange             bool
+	ReplyOnChangeSilent       bool
+	CancelAfterMissingRuns    int
+	AnnounceCancellations     bool
+	Interactive               bool
+	DigestWeekday             string
+	DigestHour                int
+	SubscribersFile           string
+	ReadyMaxFailedScrapes     int
+	CalendarAlarmsHoursBefore []int
+	StationsFile              string
 	DryRun                    bool      `json:"-"`
 	Silent                    bool      `json:"-"`
 	Verbose                   bool      `json:"-"`
@@ -32,6 +53,7 @@ func main() {
 	fakeNow := flag.String("fake-now", "", "fake the execution time (RFC3339)")
 	debug := flag.Bool("debug", false, "debug log level")
 	forceUpdate := flag.Bool("force-update", false, "force update trains")
+	trainsFile := flag.String("trains-file", "", "load trains from a dump created by tools/dump.go instead of the website")
 	flag.Parse()
 
 	cfgBytes, err := os.ReadFile("config.json")
@@ -43,6 +65,12 @@ func main() {
 		TrainsUntilYearsInFuture:  0,
 		TrainsUntilMonthsInFuture: 1,
 		TrainsUntilDaysInFuture:   0,
+		TrainsCacheMinutes:        60,
+		CancelAfterMissingRuns:    3,
+		SubscribersFile:           "subscribers.json",
+		ReadyMaxFailedScrapes:     3,
+		DigestWeekday:             "Monday",
+		DigestHour:                9,
 		FakeNow:                   time.Time{},
 	}
 
@@ -73,71 +101,186 @@ func main() {
 		cfg.TrainsUntilYearsInFuture = math.MaxInt
 	}
 
-	h, err := LoadTrainArchiveFromFile("trains.hash")
+	err = normalizeDestinations(&cfg)
 	if err != nil {
-		log.Fatalln("Cannot load train archive:", err)
+		log.Fatalln("Invalid destinations:", err)
+	}
+	if _, err := parseWeekday(cfg.DigestWeekday); err != nil {
+		log.Fatalln("Invalid DigestWeekday:", err)
+	}
+
+	for _, hours := range cfg.CalendarAlarmsHoursBefore {
+		if hours < 0 {
+			log.Fatalln("Invalid CalendarAlarmsHoursBefore:", hours)
+		}
+	}
+	if cfg.StationsFile != "" {
+		err := LoadStations(cfg.StationsFile)
+		if err != nil {
+			log.Fatalln("Cannot load stations:", err)
+		}
+	}
+
+	clock := NewClock(cfg.FakeNow)
+	if flag.Arg(0) == "history" {
+		os.Exit(historyCommand(cfg, clock, flag.Args()[1:]))
 	}
-	log.Infof("HashSet loaded, %d hashes", len(h.hash))
 
-	bot, err := NewTelegramBot(cfg)
+	var importer TrainImporter = NewFondazioneFSImporter()
+	if *trainsFile != "" {
+		log.Infoln("Loading trains from file:", *trainsFile)
+		importer = NewFileImporter(*trainsFile)
+	}
+	catalogue := NewTrainCatalogue(importer, time.Duration(cfg.TrainsCacheMinutes)*time.Minute, clock)
+
+	store, err := OpenTrainArchiveStore(cfg)
+	if err != nil {
+		log.Fatalln("Cannot open train archive:", err)
+	}
+	status := &BotStatus{}
+	h, archiveErr := NewTrainArchive(store, clock)
+	if archiveErr != nil {
+		// Without the archive every train would be sent again, keep serving the http server only
+		log.Errorln("Cannot load train archive, trains will not be sent:", archiveErr)
+		status.SetArchiveError(archiveErr)
+		h = NewEmptyTrainArchive(store, clock)
+	}
+	// Trains sent by older versions went to the first destination
+	h.MigrateMessageIDs(cfg.Destinations[0].ChannelId)
+	log.Infof("HashSet loaded, %d hashes", h.Len())
+
+	bot, err := NewTelegramBot(cfg, clock)
 	if err != nil {
 		log.Fatalln("Cannot create telegram bot:", err)
 	}
+	status.SetBot(&bot)
 	log.Infoln("Telegram bot loaded")
 
-	go startAndListenHttpServer(cfg.HttpListenAddress, cfg.HttpPublicAddress)
+	// ctx is cancelled by SIGINT and SIGTERM, the run in progress stops at the next train
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// fail stops the bot as a signal does, the cause is reported on exit
+	ctx, fail := context.WithCancelCause(ctx)
+	defer fail(nil)
+
+	var updates sync.WaitGroup
+	var subs *Subscriptions
+	if cfg.Interactive {
+		subs, err = LoadSubscriptions(cfg.SubscribersFile)
+		if err != nil {
+			log.Fatalln("Cannot load subscriptions:", err)
+		}
+		log.Infoln("Interactive mode, subscribers loaded")
+		h.MigrateSubscribersNotified()
+		updates.Add(1)
+		go func() {
+			defer updates.Done()
+			bot.HandleUpdates(ctx, subs, catalogue)
+		}()
+	}
+
+	server := NewHttpServer(cfg, clock, catalogue, h, status)
+	go func() {
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Errorln("Http server stopped:", err)
+			fail(fmt.Errorf("http server stopped: %w", err))
+		}
+	}()
 
 	ticker := time.NewTicker(time.Hour)
-	for {
-		now := time.Now()
-		if !bot.Config.FakeNow.IsZero() {
-			now = bot.Config.FakeNow
+	for ctx.Err() == nil {
+		now := clock.Now()
+		status.SetNightSkip(isNightTime(now))
+		if isNightTime(now) {
+			log.Infoln("Skipping night time:", now)
+		} else if archiveErr != nil {
+			log.Errorln("Skipping run, the train archive was not loaded:", archiveErr)
+		} else {
+			status.RecordRun(run(ctx, &bot, h, catalogue, subs))
 		}
 
-		if now.Hour() > 21 || now.Hour() < 9 {
-			log.Infoln("Skipping night time:", bot.FakeNow)
-			<-ticker.C
-			continue
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
 		}
+	}
+	ticker.Stop()
+	log.Infoln("Shutting down")
 
-		run(&bot, h)
-		<-ticker.C
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Errorln("Cannot shut down the http server:", err)
 	}
+	updates.Wait()
+
+	if archiveErr == nil {
+		err = h.Save()
+		if err != nil {
+			log.Errorln("Cannot save train archive:", err)
+		}
+	}
+	err = h.Close()
+	if err != nil {
+		log.Errorln("Cannot close train archive:", err)
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		log.Fatalln("Stopped:", cause)
+	}
+	log.Infoln("Stopped")
+}
+
+// isNightTime reports if the runs are skipped, to avoid sending messages at night
+func isNightTime(now time.Time) bool {
+	return now.Hour() > 21 || now.Hour() < 9
 }
 
-func run(bot *TelegramBot, h *TrainArchive) {
+// run sends the new trains and updates the changed ones, subs is nil when the bot is not interactive
+func run(ctx context.Context, bot *TelegramBot, h *TrainArchive, catalogue *TrainCatalogue, subs *Subscriptions) (report RunReport) {
 	log.Infoln("Running")
-	trains, err := LoadTrains()
+	report.Started = bot.clock.Now()
+	defer func() { report.Finished = bot.clock.Now() }()
+
+	trains, err := catalogue.Refresh(ctx)
 	if err != nil {
 		log.Errorln("Cannot load trains:", err)
+		report.Error = err.Error()
+		return
 	}
 
-	hashDirty := false
-	log.Println("Hash", len(h.hash))
-	now := time.Now()
+	log.Println("Hash", h.Len())
+	now := bot.clock.Now()
 	if !bot.Config.FakeNow.IsZero() {
-		log.Infoln("Faking execution time as:", bot.Config.FakeNow)
-		now = bot.Config.FakeNow
+		log.Infoln("Faking execution time as:", now)
 	}
 
 	if bot.Config.ForceUpdate {
 		log.Warnln("Force updateing trains")
 	}
 
+	// Subscribers choose the trains with their own filter, inside the window of the Config
+	subscribersUntil := windowUntil(now, bot.Config.TrainsUntilYearsInFuture, bot.Config.TrainsUntilMonthsInFuture, bot.Config.TrainsUntilDaysInFuture)
+	outcomes := make(map[TrainArchiveCompare]int)
 	for _, train := range trains {
+		if ctx.Err() != nil {
+			// Stop at a safe point, the trains already sent are saved below
+			log.Warnln("Run interrupted:", ctx.Err())
+			report.Error = ctx.Err().Error()
+			break
+		}
+		h.Seen(train)
 		when, err := train.When()
 		if err != nil {
 			log.Errorln("Cannot get train date:", train, err)
+			report.Skipped++
 			continue
 		}
 
 		if when.Before(now) {
 			log.Debugf("Skipping train %q, in the past: %q", train, when)
-			continue
-		}
-
-		if when.After(now.AddDate(bot.TrainsUntilYearsInFuture, bot.TrainsUntilMonthsInFuture, bot.TrainsUntilDaysInFuture)) {
-			log.Debugf("Skipping train %q, too far in the future: %q", train, when)
+			report.Skipped++
 			continue
 		}
 
@@ -145,40 +288,111 @@ func run(bot *TelegramBot, h *TrainArchive) {
 		if bot.Config.ForceUpdate {
 			action = TrainChanged
 		}
+		outcomes[action]++
 
 		switch action {
 		case TrainSaved:
-			log.Debugln("Skipping train, already sent:", train)
-			continue
+			log.Debugln("Train already sent:", train)
 		case TrainChanged:
-			if h.GetID(train) == 0 {
-				// Train was sent dry, do nothing
-				log.Infoln("Skipping updating train sent dry:", train)
+			log.Infoln("Changing train:", train)
+			report.Edited++
+			changes := h.Update(train)
+			for chatID, msgID := range h.GetIDs(train) {
+				if msgID == 0 {
+					// Train was sent dry, do nothing
+					log.Infoln("Skipping updating train sent dry:", train, chatID)
+					continue
+				}
+				err := bot.EditMessage(chatID, train, msgID, false)
+				if err != nil {
+					log.Errorln("Cannot change train:", train, chatID, ":", err)
+				}
+				if bot.Config.ReplyOnChange {
+					err := bot.ReplyChanges(chatID, train, msgID, changes)
+					if err != nil {
+						log.Errorln("Cannot reply changes of train:", train, chatID, ":", err)
+					}
+				}
+			}
+			if subs != nil && h.SubscribersNotified(train) {
+				bot.SendChangesToSubscribers(subs, train, changes)
+			}
+		}
+
+		// Send to the destinations whose window now includes the train
+		sent := false
+		for _, dest := range bot.Destinations {
+			if _, sent := h.GetID(train, dest.ChannelId); sent {
 				continue
 			}
-			log.Infoln("Changing train:", train)
-			err := bot.EditMessage(train, h.GetID(train))
-			if err != nil {
-				log.Errorln("Cannot change train:", train, ":", err)
+			if !dest.Accepts(train, when, now) {
+				log.Debugf("Skipping train %q for %s, filtered or too far in the future: %q", train, dest, when)
+				continue
 			}
-			h.Add(train, h.GetID(train))
-			hashDirty = true
-		case TrainNotSaved:
-			log.Infoln("Sending train:", train, when)
-			msgID, err := bot.SendTrain(train)
+
+			log.Infoln("Sending train:", train, when, "to", dest)
+			msgID, err := bot.SendTrain(dest.ChannelId, train)
 			if err != nil {
-				log.Errorln("Cannot send train:", err)
+				log.Errorln("Cannot send train:", dest, err)
 				continue
 			}
-			h.Add(train, msgID)
-			hashDirty = true
+			h.Add(train, dest.ChannelId, msgID)
+			skipElapsedReminders(h, dest, train, when, now)
+			sent = true
 		}
+		if sent {
+			report.Sent++
+		} else if action != TrainChanged {
+			report.Skipped++
+		}
+
+		if subs != nil && !h.SubscribersNotified(train) && !when.After(subscribersUntil) {
+			bot.SendToSubscribers(subs, train)
+			h.MarkSubscribersNotified(train)
+		}
+	}
+
+	observeRunTrains(outcomes)
+
+	var cancelled []Train
+	if bot.CancelAfterMissingRuns > 0 && ctx.Err() == nil {
+		cancelled = h.Missing(trains, bot.CancelAfterMissingRuns)
+	}
+	for _, train := range cancelled {
+		log.Infoln("Train cancelled:", train)
+		h.Cancel(train)
+		for chatID, msgID := range h.GetIDs(train) {
+			if msgID == 0 {
+				// Train was sent dry, do nothing
+				continue
+			}
+
+			err := bot.EditMessage(chatID, train, msgID, true)
+			if err != nil {
+				log.Errorln("Cannot mark train as cancelled:", train, chatID, ":", err)
+			}
+			if bot.Config.AnnounceCancellations {
+				err := bot.ReplyCancelled(chatID, train, msgID)
+				if err != nil {
+					log.Errorln("Cannot announce cancelled train:", train, chatID, ":", err)
+				}
+			}
+		}
+	}
+
+	if ctx.Err() == nil {
+		sendReminders(bot, h, now)
+		sendDigests(bot, h, now)
+		updatePinnedMessages(bot, h, now)
 	}
 
-	if hashDirty {
-		log.Infoln("Saving hashes")
-		h.SaveAsFile("trains.hash")
+	log.Infoln("Saving hashes")
+	err = h.Save()
+	if err != nil {
+		log.Errorln("Cannot save train archive:", err)
+		report.Error = err.Error()
 	}
 
 	log.Infoln("Done running")
+	return
 }
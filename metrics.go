@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics exported on /metrics
+var (
+	importDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "trenistorici_import_duration_seconds",
+		Help:    "Time spent loading the trains from the importer.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	importFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trenistorici_import_failures_total",
+		Help: "Number of failed imports of the trains.",
+	})
+	importedTrains = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "trenistorici_imported_trains",
+		Help: "Number of trains parsed by the last successful import.",
+	})
+	runTrains = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trenistorici_run_trains",
+		Help: "Number of trains compared with the archive in the last run, by outcome.",
+	}, []string{"outcome"})
+	telegramMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trenistorici_telegram_messages_total",
+		Help: "Number of messages sent or edited on telegram, by action and result.",
+	}, []string{"action", "result"})
+	telegramPhotoFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "trenistorici_telegram_photo_fallbacks_total",
+		Help: "Number of trains sent as text because the photo was refused.",
+	})
+	imageResizes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "trenistorici_image_resizes_total",
+		Help: "Number of train images resized before sending them, by result.",
+	}, []string{"result"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trenistorici_http_request_duration_seconds",
+		Help:    "Time spent serving the http requests, by handler and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "code"})
+)
+
+var compareOutcomeNames = map[TrainArchiveCompare]string{
+	TrainNotSaved: "new",
+	TrainChanged:  "changed",
+	TrainSaved:    "saved",
+}
+
+// observeRunTrains records the outcomes of the comparisons of a run
+func observeRunTrains(outcomes map[TrainArchiveCompare]int) {
+	for outcome, name := range compareOutcomeNames {
+		runTrains.WithLabelValues(name).Set(float64(outcomes[outcome]))
+	}
+}
+
+// resultLabel is the result label of err
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHandler records the latency and the status code of the requests served by h
+func instrumentHandler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		httpDuration.WithLabelValues(name, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// nextDepartures returns the first n upcoming trains sent to dest
+func nextDepartures(h *TrainArchive, dest Destination, now time.Time, n int) []digestTrain {
+	type dated struct {
+		digestTrain
+		when time.Time
+	}
+	var trains []dated
+	for _, train := range h.Upcoming(now) {
+		msgID, sent := h.GetID(train, dest.ChannelId)
+		when, err := train.When()
+		if !sent || err != nil {
+			continue
+		}
+
+		t := dated{digestTrain{Train: train}, when}
+		if msgID != 0 {
+			t.MessageLink = telegramMessageLink(dest.ChannelId, dest.Username, msgID)
+		}
+		trains = append(trains, t)
+	}
+	sort.Slice(trains, func(i, j int) bool { return trains[i].when.Before(trains[j].when) })
+
+	if len(trains) > n {
+		trains = trains[:n]
+	}
+	departures := make([]digestTrain, len(trains))
+	for i, t := range trains {
+		departures[i] = t.digestTrain
+	}
+	return departures
+}
+
+// updatePinnedMessages keeps the pinned message with the next departures of each destination updated,
+// the message is created and pinned the first time
+func updatePinnedMessages(bot *TelegramBot, h *TrainArchive, now time.Time) {
+	for _, dest := range bot.Destinations {
+		if dest.PinnedDepartures <= 0 {
+			continue
+		}
+
+		text, err := bot.pinnedText(nextDepartures(h, dest, now, dest.PinnedDepartures))
+		if err != nil {
+			log.Errorln("Cannot render pinned message:", dest, err)
+			continue
+		}
+		hash := md5.Sum([]byte(text))
+		textHash := hex.EncodeToString(hash[:])
+
+		pinned, found := h.Pinned(dest.ChannelId)
+		if found && pinned.TextHash == textHash {
+			continue
+		}
+		if bot.DryRun {
+			log.Infoln("Skipping pinned message, dry run:", dest)
+			continue
+		}
+
+		if found {
+			err := bot.EditPinned(dest.ChannelId, pinned.MessageID, text)
+			var apiErr *tgbotapi.Error
+			if err == nil || (errors.As(err, &apiErr) && strings.Contains(apiErr.Message, "message is not modified")) {
+				h.SetPinned(dest.ChannelId, pinnedMessage{pinned.MessageID, textHash})
+				continue
+			}
+
+			if !errors.As(err, &apiErr) || !strings.Contains(apiErr.Message, "message to edit not found") {
+				log.Errorln("Cannot edit pinned message:", dest, err)
+				continue
+			}
+			log.Warnln("Pinned message was deleted, sending a new one:", dest)
+		}
+
+		msgID, err := bot.SendPinned(dest.ChannelId, text)
+		if err != nil {
+			log.Errorln("Cannot send pinned message:", dest, err)
+			if msgID == 0 {
+				continue
+			}
+		}
+		h.SetPinned(dest.ChannelId, pinnedMessage{msgID, textHash})
+	}
+}
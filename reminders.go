@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dueReminders returns the reminders of dest that should have been sent at now
+// for a train departing at when and that were not sent yet, the closest to the departure first
+func dueReminders(h *TrainArchive, dest Destination, train Train, when time.Time, now time.Time) []int {
+	var due []int
+	for _, days := range dest.ReminderDaysBefore {
+		if now.Before(when.AddDate(0, 0, -days)) || h.ReminderSent(train, dest.ChannelId, days) {
+			continue
+		}
+		due = append(due, days)
+	}
+	sort.Ints(due)
+
+	return due
+}
+
+// skipElapsedReminders marks as sent the reminders already due when the train is announced
+func skipElapsedReminders(h *TrainArchive, dest Destination, train Train, when time.Time, now time.Time) {
+	for _, days := range dueReminders(h, dest, train, when, now) {
+		h.MarkReminderSent(train, dest.ChannelId, days)
+	}
+}
+
+// sendReminders replies to the messages of the upcoming trains with a reminder,
+// when more reminders are due (ex: the bot was stopped) only the closest to the departure is sent
+func sendReminders(bot *TelegramBot, h *TrainArchive, now time.Time) {
+	for _, train := range h.Upcoming(now) {
+		when, err := train.When()
+		if err != nil {
+			continue
+		}
+
+		for _, dest := range bot.Destinations {
+			msgID, sent := h.GetID(train, dest.ChannelId)
+			if !sent {
+				continue
+			}
+
+			due := dueReminders(h, dest, train, when, now)
+			if len(due) == 0 {
+				continue
+			}
+
+			if msgID != 0 {
+				log.Infoln("Sending reminder:", train, due[0], "days before, to", dest)
+				err := bot.ReplyReminder(dest.ChannelId, train, msgID, when, now)
+				if err != nil {
+					log.Errorln("Cannot send reminder:", train, dest, err)
+					continue
+				}
+			}
+
+			for _, days := range due {
+				h.MarkReminderSent(train, dest.ChannelId, days)
+			}
+		}
+	}
+}
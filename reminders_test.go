@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDueReminders(t *testing.T) {
+	when := time.Date(2024, time.December, 30, 8, 15, 0, 0, timezone)
+	dest := Destination{ChannelId: -1001, ReminderDaysBefore: []int{1, 7, 3}}
+	train := Train{Title: "Ferrovia dei Parchi", Link: "parchi", DateProp: "Dec 30, 2024 12:00:00 AM", DepartureTime: "8:15"}
+	tests := []struct {
+		name string
+		now  time.Time
+		sent []int
+		want []int
+	}{
+		{name: "none due", now: when.AddDate(0, 0, -8)},
+		{name: "first due", now: when.AddDate(0, 0, -7), want: []int{7}},
+		{name: "first sent", now: when.AddDate(0, 0, -5), sent: []int{7}},
+		{name: "more due", now: when.AddDate(0, 0, -2), want: []int{3, 7}},
+		{name: "more due, one sent", now: when.Add(-time.Hour), sent: []int{7}, want: []int{1, 3}},
+		{name: "all sent", now: when.Add(-time.Hour), sent: []int{1, 3, 7}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewTrainArchive(NewJSONFileStore(filepath.Join(t.TempDir(), "trains.hash")), fixedClock(tt.now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Add(train, dest.ChannelId, 12)
+			for _, days := range tt.sent {
+				h.MarkReminderSent(train, dest.ChannelId, days)
+			}
+
+			got := dueReminders(h, dest, train, when, tt.now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dueReminders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
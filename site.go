@@ -0,0 +1,133 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goodsign/monday"
+	log "github.com/sirupsen/logrus"
+)
+
+// siteTrain is a train in the list of the home page
+type siteTrain struct {
+	Train
+	URL       string
+	ImageURL  string
+	Date      string
+	Cancelled bool
+}
+
+// siteMonth contains the trains of a month
+type siteMonth struct {
+	Name   string
+	Trains []siteTrain
+}
+
+// handleIndex lists the upcoming trains grouped by month, filtered like the calendar feed
+func (s *HttpServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := filterFromQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	trains, err := s.catalogue.Trains(r.Context())
+	if err != nil {
+		log.Errorln("Cannot load trains:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	regions, _ := trainRegions(r.Context(), s.catalogue)
+
+	type found struct {
+		train     Train
+		when      time.Time
+		cancelled bool
+	}
+	now := s.clock.Now()
+	published := make(map[string]bool, len(trains))
+	var upcoming []found
+	for _, train := range trains {
+		published[train.UniqueID()] = true
+		when, err := train.When()
+		if err != nil || when.Before(now) || !filter.Match(train) {
+			continue
+		}
+		upcoming = append(upcoming, found{train, when, s.archive.IsCancelled(train.UniqueID())})
+	}
+	for _, train := range s.archive.Withdrawn(now) {
+		when, err := train.When()
+		if err != nil || published[train.UniqueID()] || !filter.Match(train) {
+			continue
+		}
+		upcoming = append(upcoming, found{train, when, true})
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool { return upcoming[i].when.Before(upcoming[j].when) })
+
+	var months []siteMonth
+	for _, f := range upcoming {
+		month := titler.String(monday.Format(f.when, "January 2006", monday.LocaleItIT))
+		if len(months) == 0 || months[len(months)-1].Name != month {
+			months = append(months, siteMonth{Name: month})
+		}
+
+		t := siteTrain{
+			Train:     f.train,
+			URL:       "/html/" + f.train.UniqueID(),
+			Date:      titler.String(monday.Format(f.when, "Monday 2 January", monday.LocaleItIT)),
+			Cancelled: f.cancelled,
+		}
+		if f.train.ImageURL != "" {
+			t.ImageURL = BaseURL + strings.TrimPrefix(f.train.ImageURL, "/")
+		}
+		months[len(months)-1].Trains = append(months[len(months)-1].Trains, t)
+	}
+
+	region := ""
+	if len(filter.Regions) > 0 {
+		region = filter.Regions[0]
+	}
+	err = indexHtmlTemplate.Execute(w, struct {
+		Regions    []string
+		Region     string
+		Locomotive string
+		Timeless   string
+		FeedURL    htmltemplate.URL
+		Months     []siteMonth
+	}{
+		regions, region, query.Get("locomotive"), query.Get("timeless"),
+		// webcal is not a scheme allowed by html/template
+		htmltemplate.URL(s.feedURL(query)), months,
+	})
+	if err != nil {
+		log.Errorln(err)
+	}
+}
+
+// feedURL returns the webcal address of the calendar feed with the given filters
+func (s *HttpServer) feedURL(query url.Values) string {
+	feed := "/ics/feed.ics"
+	if s.HttpPublicAddress != "" {
+		feed = s.HttpPublicAddress + feed
+		if u, err := url.Parse(feed); err == nil && u.Host != "" {
+			u.Scheme = "webcal"
+			feed = u.String()
+		}
+	}
+
+	filters := url.Values{}
+	for _, key := range []string{"region", "locomotive", "timeless"} {
+		if v := query.Get(key); v != "" {
+			filters.Set(key, v)
+		}
+	}
+	if len(filters) > 0 {
+		feed += "?" + filters.Encode()
+	}
+	return feed
+}
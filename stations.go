@@ -0,0 +1,70 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// StationCoordinates is the position of a station
+type StationCoordinates struct {
+	Lat float64
+	Lon float64
+}
+
+//go:embed stations.json
+var stationsSource []byte
+
+// stations contains the coordinates of the known stations, indexed by lowercase name
+var stations = make(map[string]StationCoordinates)
+
+func init() {
+	err := addStations(stationsSource)
+	if err != nil {
+		panic("Cannot load stations: " + err.Error())
+	}
+}
+
+// LoadStations adds the stations in the json file to the known ones,
+// replacing the coordinates of the stations already known
+func LoadStations(path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return addStations(body)
+}
+
+func addStations(body []byte) error {
+	var list map[string]StationCoordinates
+	err := json.Unmarshal(body, &list)
+	if err != nil {
+		return err
+	}
+
+	for name, coord := range list {
+		stations[stationKey(name)] = coord
+	}
+	return nil
+}
+
+func stationKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// stationCoordinates returns the coordinates of the station with the given name
+func stationCoordinates(name string) (StationCoordinates, bool) {
+	coord, found := stations[stationKey(name)]
+	return coord, found
+}
+
+// stationMapURL returns a link to the station on OpenStreetMap, searching it by name if the coordinates are unknown
+func stationMapURL(name string) string {
+	if coord, found := stationCoordinates(name); found {
+		return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.4f&mlon=%.4f#map=16/%.4f/%.4f", coord.Lat, coord.Lon, coord.Lat, coord.Lon)
+	}
+	return "https://www.openstreetmap.org/search?query=" + url.QueryEscape("Stazione di "+name)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RunReport is the outcome of a run
+type RunReport struct {
+	Started  time.Time
+	Finished time.Time
+	// Error is set when the run could not complete
+	Error string `json:",omitempty"`
+	// Sent, Edited and Skipped count the trains sent to at least a destination,
+	// the ones updated and the ones left untouched
+	Sent    int
+	Edited  int
+	Skipped int
+}
+
+// BotStatus keeps the state of the bot shown by /status and used by /readyz
+type BotStatus struct {
+	mu         sync.RWMutex
+	lastRun    *RunReport
+	runs       int
+	nightSkip  bool
+	archiveErr error
+	bot        string
+}
+
+// SetBot records the identity of the telegram bot
+func (s *BotStatus) SetBot(bot *TelegramBot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bot.bot != nil {
+		s.bot = "@" + bot.bot.Self.UserName
+	}
+}
+
+// SetArchiveError records that the archive could not be loaded
+func (s *BotStatus) SetArchiveError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.archiveErr = err
+}
+
+// SetNightSkip records if the runs are skipped for the night
+func (s *BotStatus) SetNightSkip(skip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nightSkip = skip
+}
+
+func (s *BotStatus) RecordRun(report RunReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastRun = &report
+	s.runs++
+}
+
+// statusResponse is the body of /status
+type statusResponse struct {
+	Ready   bool
+	Reasons []string `json:",omitempty"`
+	Bot     string
+	// NightSkip is true when the runs are skipped for the night
+	NightSkip bool
+	Runs      int
+	LastRun   *RunReport `json:",omitempty"`
+	// LastScrape is the time of the last successful import of the trains
+	LastScrape       time.Time
+	LastScrapeError  string    `json:",omitempty"`
+	LastScrapeFailed time.Time `json:",omitempty"`
+	FailedScrapes    int
+	Trains           int
+	ArchiveSize      int
+	ArchiveError     string `json:",omitempty"`
+}
+
+func (s *HttpServer) botStatus() statusResponse {
+	s.status.mu.RLock()
+	defer s.status.mu.RUnlock()
+
+	catalogue := s.catalogue.Status()
+	res := statusResponse{
+		Bot:              s.status.bot,
+		NightSkip:        s.status.nightSkip,
+		Runs:             s.status.runs,
+		LastRun:          s.status.lastRun,
+		LastScrape:       catalogue.UpdatedAt,
+		LastScrapeFailed: catalogue.LastFailure,
+		FailedScrapes:    catalogue.ConsecutiveFailures,
+		Trains:           catalogue.Trains,
+		ArchiveSize:      s.archive.Len(),
+	}
+	if catalogue.LastError != nil {
+		res.LastScrapeError = catalogue.LastError.Error()
+	}
+
+	if s.status.archiveErr != nil {
+		res.ArchiveError = s.status.archiveErr.Error()
+		res.Reasons = append(res.Reasons, "cannot load the train archive")
+	}
+	if s.ReadyMaxFailedScrapes > 0 && catalogue.ConsecutiveFailures >= s.ReadyMaxFailedScrapes {
+		res.Reasons = append(res.Reasons, fmt.Sprintf("last %d scrapes failed", catalogue.ConsecutiveFailures))
+	}
+	res.Ready = len(res.Reasons) == 0
+
+	return res
+}
+
+// handleHealth reports that the process is alive
+func (s *HttpServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady reports if the bot is working, failing if the archive could not be loaded
+// or the last ReadyMaxFailedScrapes imports failed
+func (s *HttpServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	status := s.botStatus()
+	if !status.Ready {
+		http.Error(w, "not ready: "+strings.Join(status.Reasons, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *HttpServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.botStatus())
+	if err != nil {
+		log.Errorln("Cannot encode status:", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Subscriber is a user of the interactive bot
+type Subscriber struct {
+	ChatID int64
+	Filter TrainFilter
+}
+
+// Subscriptions keeps the users of the interactive bot, it is saved as a json file
+type Subscriptions struct {
+	mu   sync.RWMutex
+	path string
+	subs map[int64]Subscriber
+}
+
+// LoadSubscriptions loads the subscribers from path, a missing file has no subscribers
+func LoadSubscriptions(path string) (*Subscriptions, error) {
+	s := &Subscriptions{
+		path: path,
+		subs: make(map[int64]Subscriber),
+	}
+
+	body, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []Subscriber
+	err = json.Unmarshal(body, &subs)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		s.subs[sub.ChatID] = sub
+	}
+
+	return s, nil
+}
+
+// save must be called with the lock held
+func (s *Subscriptions) save() error {
+	subs := make([]Subscriber, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ChatID < subs[j].ChatID })
+
+	body, err := json.MarshalIndent(subs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, body, 0644, 1)
+}
+
+// Update applies fn to the subscriber with chatID, creating it if needed, and saves the subscriptions
+func (s *Subscriptions) Update(chatID int64, fn func(sub *Subscriber)) (Subscriber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, found := s.subs[chatID]
+	if !found {
+		sub = Subscriber{ChatID: chatID}
+	}
+	fn(&sub)
+	s.subs[chatID] = sub
+
+	return sub, s.save()
+}
+
+func (s *Subscriptions) Get(chatID int64) (Subscriber, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sub, found := s.subs[chatID]
+	return sub, found
+}
+
+func (s *Subscriptions) Remove(chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subs, chatID)
+	return s.save()
+}
+
+// Matching returns the chats subscribed to the train
+func (s *Subscriptions) Matching(train Train) []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var chats []int64
+	for _, sub := range s.subs {
+		if sub.Filter.Match(train) {
+			chats = append(chats, sub.ChatID)
+		}
+	}
+	return chats
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/goodsign/monday"
+	log "github.com/sirupsen/logrus"
+)
+
+// inlineMaxResults is the maximum number of results accepted by Telegram
+const inlineMaxResults = 50
+
+// SearchTrains returns the upcoming trains containing every word of query,
+// searching in title, subtitle, region, stations and locomotive. Trains are sorted by date.
+func SearchTrains(trains []Train, query string, clock Clock) []Train {
+	terms := strings.Fields(strings.ToLower(query))
+	now := clock.Now()
+
+	type found struct {
+		train Train
+		when  int64
+	}
+	var results []found
+	for _, train := range trains {
+		when, err := train.When()
+		if err != nil || when.Before(now) {
+			continue
+		}
+
+		text := strings.ToLower(strings.Join([]string{
+			train.Title, train.Subtitle, train.Region,
+			train.DepartureStation, train.ArriveStation, train.Locomotive,
+		}, " "))
+		match := true
+		for _, term := range terms {
+			if !strings.Contains(text, term) {
+				match = false
+				break
+			}
+		}
+		if match {
+			results = append(results, found{train, when.Unix()})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].when < results[j].when })
+	matching := make([]Train, len(results))
+	for i, r := range results {
+		matching[i] = r.train
+	}
+	return matching
+}
+
+// answerInlineQuery answers with the upcoming trains matching the query
+func (b *TelegramBot) answerInlineQuery(ctx context.Context, query *tgbotapi.InlineQuery, catalogue *TrainCatalogue) {
+	trains, err := catalogue.Trains(ctx)
+	if err != nil {
+		log.Errorln("Cannot load trains for inline query:", err)
+	}
+
+	matching := SearchTrains(trains, query.Query, b.clock)
+	if len(matching) > inlineMaxResults {
+		matching = matching[:inlineMaxResults]
+	}
+
+	results := make([]interface{}, 0, len(matching))
+	for _, train := range matching {
+		caption, err := b.trainCaption(train, false)
+		if err != nil {
+			log.Errorln("Cannot render train for inline query:", train, err)
+			continue
+		}
+
+		// The id is limited to 64 bytes, UniqueID can be longer
+		article := tgbotapi.NewInlineQueryResultArticleMarkdownV2(train.Hash(), train.Title, caption)
+		when, _ := train.When()
+		article.Description = monday.Format(when, "2 January 2006", monday.LocaleItIT) + " - " + train.DepartureStation + " → " + train.ArriveStation
+		article.ThumbURL = BaseURL + strings.TrimPrefix(train.ImageURL, "/")
+		keyboard := b.trainKeyboard(train)
+		article.ReplyMarkup = &keyboard
+		results = append(results, article)
+	}
+
+	_, err = b.bot.Request(tgbotapi.InlineConfig{
+		InlineQueryID: query.ID,
+		Results:       results,
+		CacheTime:     300,
+	})
+	if err != nil {
+		log.Errorln("Cannot answer inline query:", query.Query, err)
+	}
+}
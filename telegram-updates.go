@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const interactiveHelp = `Ciao! Ti invierò i nuovi treni storici di Fondazione FS.
+
+/regioni mostra le regioni disponibili
+/iscrivi <regione> ricevi solo i treni della regione, puoi iscriverti a più regioni
+/locomotiva <tipo> ricevi solo i treni con la locomotiva indicata (vapore, diesel, elettrica, automotrici, elettrotreno), "tutte" per rimuovere il filtro
+/stop non ricevere più treni`
+
+// HandleUpdates answers the commands sent in private chats and the inline queries until ctx is done
+func (b *TelegramBot) HandleUpdates(ctx context.Context, subs *Subscriptions, catalogue *TrainCatalogue) {
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates := b.bot.GetUpdatesChan(u)
+	defer b.bot.StopReceivingUpdates()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if update.InlineQuery != nil {
+				b.answerInlineQuery(ctx, update.InlineQuery, catalogue)
+				continue
+			}
+			if update.Message == nil || !update.Message.Chat.IsPrivate() || !update.Message.IsCommand() {
+				continue
+			}
+
+			reply := b.handleCommand(ctx, update.Message, subs, catalogue)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
+			_, err := b.send("command", msg)
+			if err != nil {
+				log.Errorln("Cannot reply to command:", update.Message.Command(), err)
+			}
+		}
+	}
+}
+
+func (b *TelegramBot) handleCommand(ctx context.Context, msg *tgbotapi.Message, subs *Subscriptions, catalogue *TrainCatalogue) string {
+	chatID := msg.Chat.ID
+	args := strings.TrimSpace(msg.CommandArguments())
+	log.Debugln("Received command:", chatID, msg.Command(), args)
+
+	switch msg.Command() {
+	case "start", "help":
+		_, err := subs.Update(chatID, func(sub *Subscriber) {})
+		if err != nil {
+			log.Errorln("Cannot save subscriptions:", err)
+			return "Si è verificato un errore, riprova più tardi"
+		}
+		return interactiveHelp
+
+	case "regioni":
+		regions, err := trainRegions(ctx, catalogue)
+		if err != nil {
+			log.Errorln("Cannot load trains:", err)
+			return "Non riesco a caricare i treni, riprova più tardi"
+		}
+		text := "Regioni con treni in programma:\n" + strings.Join(regions, "\n")
+		if sub, found := subs.Get(chatID); found && len(sub.Filter.Regions) > 0 {
+			text += "\n\nSei iscritto a: " + strings.Join(sub.Filter.Regions, ", ")
+		}
+		return text
+
+	case "iscrivi":
+		if args == "" {
+			return "Indica la regione, ad esempio: /iscrivi Toscana"
+		}
+		region := titler.String(args)
+		regions, err := trainRegions(ctx, catalogue)
+		if err == nil {
+			found := false
+			for _, r := range regions {
+				if strings.EqualFold(r, args) {
+					region = r
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Sprintf("Non ci sono treni in %q, usa /regioni per vedere le regioni disponibili", args)
+			}
+		}
+
+		sub, err := subs.Update(chatID, func(sub *Subscriber) {
+			if !containsFold(sub.Filter.Regions, region) {
+				sub.Filter.Regions = append(sub.Filter.Regions, region)
+			}
+		})
+		if err != nil {
+			log.Errorln("Cannot save subscriptions:", err)
+			return "Si è verificato un errore, riprova più tardi"
+		}
+		return "Riceverai i treni di: " + strings.Join(sub.Filter.Regions, ", ")
+
+	case "locomotiva":
+		if args == "" {
+			return "Indica il tipo di locomotiva, ad esempio: /locomotiva vapore"
+		}
+
+		sub, err := subs.Update(chatID, func(sub *Subscriber) {
+			if strings.EqualFold(args, "tutte") {
+				sub.Filter.Locomotives = nil
+				return
+			}
+			sub.Filter.Locomotives = []string{strings.ToLower(args)}
+		})
+		if err != nil {
+			log.Errorln("Cannot save subscriptions:", err)
+			return "Si è verificato un errore, riprova più tardi"
+		}
+		if len(sub.Filter.Locomotives) == 0 {
+			return "Riceverai i treni con qualsiasi locomotiva"
+		}
+		return "Riceverai solo i treni con locomotiva " + sub.Filter.Locomotives[0]
+
+	case "stop":
+		err := subs.Remove(chatID)
+		if err != nil {
+			log.Errorln("Cannot save subscriptions:", err)
+			return "Si è verificato un errore, riprova più tardi"
+		}
+		return "Non riceverai più treni, usa /start per iscriverti di nuovo"
+	}
+
+	return "Comando sconosciuto\n\n" + interactiveHelp
+}
+
+// trainRegions returns the sorted regions of the published trains
+func trainRegions(ctx context.Context, catalogue *TrainCatalogue) ([]string, error) {
+	trains, err := catalogue.Trains(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var regions []string
+	for _, t := range trains {
+		if t.Region != "" && !seen[t.Region] {
+			seen[t.Region] = true
+			regions = append(regions, t.Region)
+		}
+	}
+	sort.Strings(regions)
+
+	return regions, nil
+}
+
+// SendToSubscribers sends the train to every subscriber interested in it,
+// subscribers that blocked the bot are removed
+func (b *TelegramBot) SendToSubscribers(subs *Subscriptions, train Train) {
+	b.sendToSubscribers(subs, train, func(chatID int64) error {
+		_, err := b.SendTrain(chatID, train)
+		return err
+	})
+}
+
+// SendChangesToSubscribers sends the changes of the train to every subscriber interested in it,
+// nothing is sent if none of the changes is in changeReplyFields
+func (b *TelegramBot) SendChangesToSubscribers(subs *Subscriptions, train Train, changes []FieldChange) {
+	if len(announcedChanges(changes)) == 0 {
+		return
+	}
+
+	b.sendToSubscribers(subs, train, func(chatID int64) error {
+		return b.ReplyChanges(chatID, train, 0, changes)
+	})
+}
+
+func (b *TelegramBot) sendToSubscribers(subs *Subscriptions, train Train, send func(chatID int64) error) {
+	for _, chatID := range subs.Matching(train) {
+		err := send(chatID)
+		if err == nil {
+			continue
+		}
+
+		var apiErr *tgbotapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+			log.Infoln("Subscriber blocked the bot, removing:", chatID)
+			err = subs.Remove(chatID)
+		}
+		if err != nil {
+			log.Errorln("Cannot send train to subscriber:", chatID, err)
+		}
+	}
+}
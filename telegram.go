@@ -26,11 +26,70 @@ import (
 //go:embed telegram.tmpl
 var msgTemplateSource string
 
+//go:embed telegram-change.tmpl
+var changeTemplateSource string
+
+//go:embed telegram-cancel.tmpl
+var cancelTemplateSource string
+
+//go:embed telegram-reminder.tmpl
+var reminderTemplateSource string
+
+//go:embed telegram-digest.tmpl
+var digestTemplateSource string
+
+//go:embed telegram-pinned.tmpl
+var pinnedTemplateSource string
+
 var msgTemplate = template.Must(template.New("telegram").Funcs(template.FuncMap{
 	"escape":      escapeTelegramText,
 	"convertDate": convertDate,
 }).Parse(msgTemplateSource))
 
+var changeTemplate = template.Must(template.New("telegram-change").Funcs(template.FuncMap{
+	"escape": escapeTelegramText,
+}).Parse(changeTemplateSource))
+
+var cancelTemplate = template.Must(template.New("telegram-cancel").Funcs(template.FuncMap{
+	"escape":      escapeTelegramText,
+	"convertDate": convertDate,
+}).Parse(cancelTemplateSource))
+
+var reminderTemplate = template.Must(template.New("telegram-reminder").Funcs(template.FuncMap{
+	"escape":      escapeTelegramText,
+	"convertDate": convertDate,
+}).Parse(reminderTemplateSource))
+
+var digestTemplate = template.Must(template.New("telegram-digest").Funcs(template.FuncMap{
+	"escape":      escapeTelegramText,
+	"convertDate": convertDate,
+}).Parse(digestTemplateSource))
+
+var pinnedTemplate = template.Must(template.New("telegram-pinned").Funcs(template.FuncMap{
+	"escape":      escapeTelegramText,
+	"convertDate": convertDate,
+}).Parse(pinnedTemplateSource))
+
+// changeReplyFields are the fields of a train announced when they change, in order
+var changeReplyFields = []struct {
+	Field string
+	Label string
+}{
+	{"MonthDay", "📅 Data"},
+	{"DepartureStation", "Stazione di partenza"},
+	{"DepartureTime", "Orario di partenza"},
+	{"ArriveStation", "Stazione di arrivo"},
+	{"ArriveTime", "Orario di arrivo"},
+	{"ReturnDepartureTime", "🔙 Orario di partenza del ritorno"},
+	{"ReturnArriveTime", "🔙 Orario di arrivo del ritorno"},
+	{"PriceAdult", "🏷️ Prezzo"},
+	{"PriceChildren", "🏷️ Prezzo bambini"},
+	{"PriceAdultReturn", "🏷️ Prezzo del ritorno"},
+	{"PriceChildrenReturn", "🏷️ Prezzo bambini del ritorno"},
+	{"Locomotive", "Locomotiva"},
+	{"LocomotiveDetails", "Dettagli locomotiva"},
+}
+
 func escapeTelegramText(text string) string {
 	return strings.NewReplacer(
 		"_", "\\_",
@@ -64,38 +123,68 @@ func convertDate(date time.Time) string {
 type TelegramBot struct {
 	bot *tgbotapi.BotAPI
 	Config
+	clock Clock
 
-	lastNotification time.Time
+	lastNotification map[int64]time.Time
 }
 
-func NewTelegramBot(cfg Config) (TelegramBot, error) {
+func NewTelegramBot(cfg Config, clock Clock) (TelegramBot, error) {
 	token := cfg.TelegramBotToken
 	bot, err := tgbotapi.NewBotAPI(token)
 
 	return TelegramBot{
 		bot:              bot,
 		Config:           cfg,
-		lastNotification: time.Unix(0, 0),
+		clock:            clock,
+		lastNotification: make(map[int64]time.Time),
 	}, err
 }
 
-func (b *TelegramBot) SendTrain(train Train) (int, error) {
+// trainCaption renders the message of the train
+func (b *TelegramBot) trainCaption(train Train, cancelled bool) (string, error) {
 	text := &bytes.Buffer{}
 	data := struct {
 		Train
 
-		Verbose bool
+		Verbose   bool
+		Cancelled bool
 	}{
 		train,
 		b.Config.Verbose,
+		cancelled,
 	}
 
 	err := msgTemplate.Execute(text, data)
 	if err != nil {
-		return 0, fmt.Errorf("cannot execute template: %w", err)
+		return "", fmt.Errorf("cannot execute template: %w", err)
 	}
 
+	return html.UnescapeString(text.String()), nil
+}
+
+// trainKeyboard creates the buttons shown below the message of the train
+func (b *TelegramBot) trainKeyboard(train Train) tgbotapi.InlineKeyboardMarkup {
 	link := BaseURL + strings.TrimPrefix(train.Link, "/")
+	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonURL("Maggiori informazioni", link),
+	))
+	canAddToCalendar, calendarUrl := httpAddressForTrain(train, b.Config.HttpPublicAddress, "/html/")
+	if canAddToCalendar {
+		inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonURL("Aggiungi al calendario", calendarUrl)),
+		)
+	}
+
+	return inlineKeyboard
+}
+
+// SendTrain sends the train to chatID, returning the id of the message
+func (b *TelegramBot) SendTrain(chatID int64, train Train) (int, error) {
+	caption, err := b.trainCaption(train, false)
+	if err != nil {
+		return 0, err
+	}
+
 	image := BaseURL + strings.TrimPrefix(train.ImageURL, "/")
 
 	// Check image size
@@ -121,6 +210,7 @@ func (b *TelegramBot) SendTrain(train Train) (int, error) {
 			log.Warnln("Cannot get train image:", err)
 		}
 		resized, err := resizeImage(res.Body)
+		imageResizes.WithLabelValues(resultLabel(err)).Inc()
 		if err != nil {
 			log.Warnln("Cannot resize image:", err)
 		} else {
@@ -145,24 +235,14 @@ func (b *TelegramBot) SendTrain(train Train) (int, error) {
 	}
 defaultImg:
 
-	msg := tgbotapi.NewPhoto(b.ChannelId, img)
-	msg.Caption = html.UnescapeString(text.String())
+	msg := tgbotapi.NewPhoto(chatID, img)
+	msg.Caption = caption
 	msg.ParseMode = tgbotapi.ModeMarkdownV2
-	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonURL("Maggiori informazioni", link),
-	))
-	canAddToCalendar, calendarUrl := httpHtmlAddressForTrain(train, b.Config.HttpPublicAddress)
-	if canAddToCalendar {
-		inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonURL("Aggiungi al calendario", calendarUrl)),
-		)
-	}
-
-	msg.ReplyMarkup = inlineKeyboard
+	msg.ReplyMarkup = b.trainKeyboard(train)
 	msg.DisableNotification = b.Config.Silent
 
-	if time.Now().After(b.lastNotification.Add(10 * time.Minute)) {
-		b.lastNotification = time.Now()
+	if now := b.clock.Now(); now.After(b.lastNotification[chatID].Add(10 * time.Minute)) {
+		b.lastNotification[chatID] = now
 		log.Infoln("Sending notification")
 	} else {
 		msg.DisableNotification = true
@@ -173,14 +253,15 @@ defaultImg:
 		return 0, nil
 	}
 
-	msgRes, err := b.bot.Send(msg)
+	msgRes, err := b.send("send", msg)
 	if err != nil {
 		log.Errorln("Cannot send train, retring without photo:", train, image, err)
+		telegramPhotoFallbacks.Inc()
 
-		safeMsg := tgbotapi.NewMessage(b.ChannelId, msg.Caption)
+		safeMsg := tgbotapi.NewMessage(chatID, msg.Caption)
 		safeMsg.ParseMode = tgbotapi.ModeMarkdownV2
 		safeMsg.ReplyMarkup = msg.ReplyMarkup
-		_, err = b.bot.Send(safeMsg)
+		msgRes, err = b.send("send", safeMsg)
 		if err != nil {
 			return 0, fmt.Errorf("cannot send safe message: %q %w", train, err)
 		}
@@ -189,39 +270,204 @@ defaultImg:
 	return msgRes.MessageID, nil
 }
 
-func (b *TelegramBot) EditMessage(train Train, msgID int) error {
-	link := BaseURL + strings.TrimPrefix(train.Link, "/")
+// EditMessage updates the message of the train, cancelled adds the cancellation banner
+func (b *TelegramBot) EditMessage(chatID int64, train Train, msgID int, cancelled bool) error {
+	caption, err := b.trainCaption(train, cancelled)
+	if err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewEditMessageCaption(chatID, msgID, caption)
+
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	inlineKeyboard := b.trainKeyboard(train)
+	msg.ReplyMarkup = &inlineKeyboard
+	if !b.Config.DryRun {
+		_, err = b.send("edit", msg)
+	}
+	return err
+}
+
+// ReplyCancelled replies to the message of the train announcing it was cancelled
+func (b *TelegramBot) ReplyCancelled(chatID int64, train Train, msgID int) error {
 	text := &bytes.Buffer{}
-	data := struct {
+	err := cancelTemplate.Execute(text, train)
+	if err != nil {
+		return fmt.Errorf("cannot execute template: %w", err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, html.UnescapeString(text.String()))
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	msg.ReplyToMessageID = msgID
+	msg.DisableNotification = b.Config.Silent
+
+	if b.Config.DryRun {
+		log.Infof("Skipping cancellation reply, dry run %q\n", train)
+		return nil
+	}
+
+	_, err = b.send("reply", msg)
+	return err
+}
+
+// announcedChange is a change of a field in changeReplyFields
+type announcedChange struct {
+	Label string
+	Old   string
+	New   string
+}
+
+// announcedChanges returns the changes of the fields in changeReplyFields, in their order
+func announcedChanges(changes []FieldChange) []announcedChange {
+	var announced []announcedChange
+	for _, field := range changeReplyFields {
+		for _, change := range changes {
+			if change.Field == field.Field {
+				announced = append(announced, announcedChange{field.Label, change.Old, change.New})
+			}
+		}
+	}
+	return announced
+}
+
+// ReplyChanges replies to the message of the train listing the changes, with msgID 0 the message is not a reply.
+// Nothing is sent if none of the changes is in changeReplyFields
+func (b *TelegramBot) ReplyChanges(chatID int64, train Train, msgID int, changes []FieldChange) error {
+	announced := announcedChanges(changes)
+	if len(announced) == 0 {
+		return nil
+	}
+
+	text := &bytes.Buffer{}
+	err := changeTemplate.Execute(text, struct {
 		Train
-		Verbose bool
-	}{train, b.Config.Verbose}
-	err := msgTemplate.Execute(text, data)
+		Changes []announcedChange
+	}{train, announced})
 	if err != nil {
 		return fmt.Errorf("cannot execute template: %w", err)
 	}
 
-	caption := html.UnescapeString(text.String())
-	msg := tgbotapi.NewEditMessageCaption(b.ChannelId, msgID, caption)
+	msg := tgbotapi.NewMessage(chatID, html.UnescapeString(text.String()))
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	msg.ReplyToMessageID = msgID
+	msg.DisableNotification = b.Config.Silent || b.Config.ReplyOnChangeSilent
+
+	if b.Config.DryRun {
+		log.Infof("Skipping change reply, dry run %q\n", train)
+		return nil
+	}
+
+	_, err = b.send("reply", msg)
+	return err
+}
+
+// ReplyReminder replies to the message of the train reminding the departure
+func (b *TelegramBot) ReplyReminder(chatID int64, train Train, msgID int, when time.Time, now time.Time) error {
+	// Calendar days, a train tomorrow morning is 1 day away even if less than 24 hours are left
+	y, m, d := now.In(timezone).Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, timezone)
+	days := int(when.Sub(today).Hours() / 24)
+
+	text := &bytes.Buffer{}
+	err := reminderTemplate.Execute(text, struct {
+		Train
+		Days int
+	}{train, days})
+	if err != nil {
+		return fmt.Errorf("cannot execute template: %w", err)
+	}
 
+	msg := tgbotapi.NewMessage(chatID, html.UnescapeString(text.String()))
 	msg.ParseMode = tgbotapi.ModeMarkdownV2
-	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonURL("Maggiori informazioni", link),
-	))
-	canAddToCalendar, calendarUrl := httpHtmlAddressForTrain(train, b.Config.HttpPublicAddress)
-	if canAddToCalendar {
-		inlineKeyboard.InlineKeyboard = append(inlineKeyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonURL("Aggiungi al calendario", calendarUrl)),
-		)
+	msg.ReplyToMessageID = msgID
+	msg.DisableNotification = b.Config.Silent
+
+	if b.Config.DryRun {
+		log.Infof("Skipping reminder, dry run %q\n", train)
+		return nil
 	}
 
-	msg.ReplyMarkup = &inlineKeyboard
-	if !b.Config.DryRun {
-		_, err = b.bot.Send(msg)
+	_, err = b.send("reply", msg)
+	return err
+}
+
+// SendDigest sends the list of the trains of the next days
+func (b *TelegramBot) SendDigest(chatID int64, days int, schedule []digestDay) error {
+	text := &bytes.Buffer{}
+	err := digestTemplate.Execute(text, struct {
+		Days     int
+		Schedule []digestDay
+	}{days, schedule})
+	if err != nil {
+		return fmt.Errorf("cannot execute template: %w", err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, html.UnescapeString(text.String()))
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	msg.DisableWebPagePreview = true
+	msg.DisableNotification = b.Config.Silent
+
+	if b.Config.DryRun {
+		log.Infoln("Skipping digest, dry run")
+		return nil
 	}
+
+	_, err = b.send("digest", msg)
 	return err
 }
 
+func (b *TelegramBot) pinnedText(departures []digestTrain) (string, error) {
+	text := &bytes.Buffer{}
+	err := pinnedTemplate.Execute(text, departures)
+	if err != nil {
+		return "", fmt.Errorf("cannot execute template: %w", err)
+	}
+
+	return html.UnescapeString(text.String()), nil
+}
+
+// SendPinned sends and pins the message with the next departures,
+// if only pinning fails the id of the message is returned with the error
+func (b *TelegramBot) SendPinned(chatID int64, text string) (int, error) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	msg.DisableWebPagePreview = true
+	msg.DisableNotification = true
+
+	sent, err := b.send("pinned", msg)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = b.bot.Request(tgbotapi.PinChatMessageConfig{
+		ChatID:              chatID,
+		MessageID:           sent.MessageID,
+		DisableNotification: true,
+	})
+	if err != nil {
+		return sent.MessageID, fmt.Errorf("cannot pin message: %w", err)
+	}
+
+	return sent.MessageID, nil
+}
+
+// EditPinned replaces the text of the message with the next departures
+func (b *TelegramBot) EditPinned(chatID int64, msgID int, text string) error {
+	msg := tgbotapi.NewEditMessageText(chatID, msgID, text)
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	msg.DisableWebPagePreview = true
+
+	_, err := b.send("pinned", msg)
+	return err
+}
+
+// send sends c on telegram, counting it in the metrics by action
+func (b *TelegramBot) send(action string, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg, err := b.bot.Send(c)
+	telegramMessages.WithLabelValues(action, resultLabel(err)).Inc()
+	return msg, err
+}
+
 // resizeImage resizes the given images, it doesn't check
 // if the output size is smaller than the requirement
 func resizeImage(r io.Reader) (io.Reader, error) {
@@ -1,23 +1,51 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+// FondazioneFSTrainsURL is the page containing the #gridList with all the scheduled trains
+var FondazioneFSTrainsURL = "https://www.fondazionefs.it/content/fondazionefs/it/treni-storici.html"
+
+// TrainImporter is a source of trains
 type TrainImporter interface {
-	Trains() []Train
+	Trains(ctx context.Context) ([]Train, error)
+}
+
+// FondazioneFSImporter scrapes the trains from the Fondazione FS website
+type FondazioneFSImporter struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewFondazioneFSImporter() *FondazioneFSImporter {
+	return &FondazioneFSImporter{
+		URL:    FondazioneFSTrainsURL,
+		Client: http.DefaultClient,
+	}
 }
 
-func LoadTrains() ([]Train, error) {
-	res, err := http.Get("https://www.fondazionefs.it/content/fondazionefs/it/treni-storici.html")
+func (i *FondazioneFSImporter) Trains(ctx context.Context) ([]Train, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := i.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
 	doc, err := goquery.NewDocumentFromReader(res.Body)
 	if err != nil {
 		return nil, err
@@ -28,11 +56,34 @@ func LoadTrains() ([]Train, error) {
 		return nil, errors.New("cannot find trains")
 	}
 
+	return parseTrainList([]byte(rawJson))
+}
+
+// FileImporter reads the trains from a file created by tools/dump.go
+type FileImporter struct {
+	Path string
+}
+
+func NewFileImporter(path string) *FileImporter {
+	return &FileImporter{Path: path}
+}
+
+func (i *FileImporter) Trains(ctx context.Context) ([]Train, error) {
+	body, err := os.ReadFile(i.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTrainList(body)
+}
+
+// parseTrainList decodes the content of the #gridList input
+func parseTrainList(rawJson []byte) ([]Train, error) {
 	unmarshal := struct {
 		AlreadyLoaded int
 		TrainsList    []Train
 	}{}
-	err = json.Unmarshal([]byte(rawJson), &unmarshal)
+	err := json.Unmarshal(rawJson, &unmarshal)
 	if err != nil {
 		return nil, err
 	}
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -62,6 +63,7 @@ type Train struct {
 	LocomotiveDetails   string `json:"locomotiveOtherDetails"`
 	Month               string `json:"month"`
 	MonthDay            string `json:"date"`
+	DateProp            string `json:"dateProp"`
 	IsTimeless          bool   `json:"isTimeless"`
 	DepartureStation    string `json:"departureStation"`
 	DepartureTime       string `json:"departureHour"`
@@ -74,12 +76,28 @@ type Train struct {
 	PriceChildren       string `json:"priceChild,omitempty"`
 	PriceAdultReturn    string `json:"priceAdultReturn,omitempty"`
 	PriceChildrenReturn string `json:"priceChildReturn,omitempty"`
+
+	// clock is used when the year of the train must be guessed
+	clock Clock
 }
 
 func (t Train) String() string {
 	return t.Title
 }
 
+// WithClock returns a copy of the train using the given clock
+func (t Train) WithClock(clock Clock) Train {
+	t.clock = clock
+	return t
+}
+
+func (t Train) now() time.Time {
+	if t.clock == nil {
+		return time.Now()
+	}
+	return t.clock.Now()
+}
+
 func (t Train) When() (time.Time, error) {
 	departureTime := t.DepartureTime
 	if len(strings.TrimSpace(departureTime)) == 0 {
@@ -87,24 +105,109 @@ func (t Train) When() (time.Time, error) {
 		departureTime = "10:00"
 	}
 
-	date, err := time.Parse("2/1 15:4", t.MonthDay+" "+departureTime)
+	hour, err := time.Parse("15:4", strings.TrimSpace(departureTime))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse train time: (%s) %w", departureTime, err)
+	}
+
+	date, err := t.Date()
+	if err != nil {
+		log.Debugln("Cannot use train dateProp, guessing year:", err)
+		date, err = t.guessDate()
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Date(date.Year(), date.Month(), date.Day(), hour.Hour(), hour.Minute(), 0, 0, timezone), nil
+}
+
+// Date parses the full date of the train (dateProp) using DateFormats
+func (t Train) Date() (time.Time, error) {
+	if t.DateProp == "" {
+		return time.Time{}, errors.New("train without dateProp")
+	}
+
+	for _, format := range DateFormats {
+		date, err := time.ParseInLocation(format, t.DateProp, timezone)
+		if err == nil {
+			return date, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse train dateProp: %q", t.DateProp)
+}
+
+// guessDate uses the day and the month of the train, the year is chosen
+// so that the train is between 3 months in the past and 9 months in the future
+func (t Train) guessDate() (time.Time, error) {
+	dayMonth, err := time.Parse("2/1", strings.TrimSpace(t.MonthDay))
 	if err != nil {
-		return time.Time{}, fmt.Errorf("cannot parse train date: (%s) %w", t.MonthDay+" "+departureTime, err)
+		return time.Time{}, fmt.Errorf("cannot parse train date: (%s) %w", t.MonthDay, err)
 	}
 
-	date = date.AddDate(time.Now().Year(), 0, 0)
-	if time.Now().Month() > 10 && date.Month() < 3 {
+	now := t.now().In(timezone)
+	date := time.Date(now.Year(), dayMonth.Month(), dayMonth.Day(), 0, 0, 0, 0, timezone)
+	if date.Before(now.AddDate(0, -3, 0)) {
 		// Rollover
 		log.Debugln("Rollover date", date)
 		date = date.AddDate(1, 0, 0)
+	} else if !date.Before(now.AddDate(0, 9, 0)) {
+		date = date.AddDate(-1, 0, 0)
 	}
 
 	return date, nil
 }
 
+// trainHashFields are the fields of the train hashed by Hash. Archives store the hash,
+// fields added to Train must not be added here or every archived train would look changed.
+type trainHashFields struct {
+	Title               string `json:"title"`
+	Subtitle            string `json:"subtitle"`
+	Link                string `json:"link"`
+	Region              string `json:"region"`
+	Locomotive          string `json:"locomotive"`
+	LocomotiveDetails   string `json:"locomotiveOtherDetails"`
+	Month               string `json:"month"`
+	MonthDay            string `json:"date"`
+	IsTimeless          bool   `json:"isTimeless"`
+	DepartureStation    string `json:"departureStation"`
+	DepartureTime       string `json:"departureHour"`
+	ArriveStation       string `json:"arriveStation"`
+	ArriveTime          string `json:"arriveHour"`
+	ImageURL            string `json:"image"`
+	ReturnDepartureTime string `json:"returnDepartureHour"`
+	ReturnArriveTime    string `json:"returnArriveHour"`
+	PriceAdult          string `json:"priceAdult,omitempty"`
+	PriceChildren       string `json:"priceChild,omitempty"`
+	PriceAdultReturn    string `json:"priceAdultReturn,omitempty"`
+	PriceChildrenReturn string `json:"priceChildReturn,omitempty"`
+}
+
 func (t Train) Hash() string {
 	hasher := md5.New()
-	body, err := json.Marshal(t)
+	body, err := json.Marshal(trainHashFields{
+		Title:               t.Title,
+		Subtitle:            t.Subtitle,
+		Link:                t.Link,
+		Region:              t.Region,
+		Locomotive:          t.Locomotive,
+		LocomotiveDetails:   t.LocomotiveDetails,
+		Month:               t.Month,
+		MonthDay:            t.MonthDay,
+		IsTimeless:          t.IsTimeless,
+		DepartureStation:    t.DepartureStation,
+		DepartureTime:       t.DepartureTime,
+		ArriveStation:       t.ArriveStation,
+		ArriveTime:          t.ArriveTime,
+		ImageURL:            t.ImageURL,
+		ReturnDepartureTime: t.ReturnDepartureTime,
+		ReturnArriveTime:    t.ReturnArriveTime,
+		PriceAdult:          t.PriceAdult,
+		PriceChildren:       t.PriceChildren,
+		PriceAdultReturn:    t.PriceAdultReturn,
+		PriceChildrenReturn: t.PriceChildrenReturn,
+	})
 	if err != nil {
 		panic(fmt.Sprintf("Cannot hash train, this may not happen: %v", err))
 	}
@@ -113,6 +216,11 @@ func (t Train) Hash() string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// Price returns the adult price of the train, ok is false if it is missing
+func (t Train) Price() (price float64, ok bool) {
+	return parsePrice(t.PriceAdult)
+}
+
 func (t Train) UniqueID() string {
 	return strings.TrimSuffix(strings.TrimPrefix(t.Link, "/content/fondazionefs/it/treni-storici/"), ".html")
 }
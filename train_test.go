@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrainWhen(t *testing.T) {
+	now := time.Date(2024, time.November, 15, 12, 0, 0, 0, timezone)
+	tests := []struct {
+		name  string
+		train Train
+		now   time.Time
+		want  time.Time
+	}{
+		{
+			name:  "dateProp",
+			train: Train{DateProp: "Dec 30, 2022 12:00:00 AM", MonthDay: "30/12", DepartureTime: "8:15"},
+			now:   now,
+			want:  time.Date(2022, time.December, 30, 8, 15, 0, 0, timezone),
+		},
+		{
+			name:  "dateProp with comma",
+			train: Train{DateProp: "Mar 2, 2025, 12:00:00 AM", MonthDay: "2/3", DepartureTime: "14:05"},
+			now:   now,
+			want:  time.Date(2025, time.March, 2, 14, 5, 0, 0, timezone),
+		},
+		{
+			name:  "without time",
+			train: Train{DateProp: "Dec 30, 2024 12:00:00 AM"},
+			now:   now,
+			want:  time.Date(2024, time.December, 30, 10, 0, 0, 0, timezone),
+		},
+		{
+			name:  "guessed this year",
+			train: Train{MonthDay: "20/12", DepartureTime: "9:30"},
+			now:   now,
+			want:  time.Date(2024, time.December, 20, 9, 30, 0, 0, timezone),
+		},
+		{
+			name:  "guessed in the recent past",
+			train: Train{MonthDay: "20/8", DepartureTime: "9:30"},
+			now:   now,
+			want:  time.Date(2024, time.August, 20, 9, 30, 0, 0, timezone),
+		},
+		{
+			name:  "guessed next year",
+			train: Train{MonthDay: "10/1", DepartureTime: "9:30"},
+			now:   now,
+			want:  time.Date(2025, time.January, 10, 9, 30, 0, 0, timezone),
+		},
+		{
+			name:  "guessed last year",
+			train: Train{MonthDay: "20/12", DepartureTime: "9:30"},
+			now:   time.Date(2024, time.February, 1, 12, 0, 0, 0, timezone),
+			want:  time.Date(2023, time.December, 20, 9, 30, 0, 0, timezone),
+		},
+		{
+			name:  "invalid dateProp",
+			train: Train{DateProp: "30/12/2024", MonthDay: "30/12", DepartureTime: "9:30"},
+			now:   now,
+			want:  time.Date(2024, time.December, 30, 9, 30, 0, 0, timezone),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.train.WithClock(fixedClock(tt.now)).When()
+			if err != nil {
+				t.Fatalf("When() error: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("When() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrainWhenInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		train Train
+	}{
+		{"invalid time", Train{MonthDay: "20/12", DepartureTime: "nove"}},
+		{"invalid date", Train{MonthDay: "", DepartureTime: "9:30"}},
+	}
+
+	clock := fixedClock(time.Date(2024, time.November, 15, 12, 0, 0, 0, timezone))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.train.WithClock(clock).When()
+			if err == nil {
+				t.Errorf("When() = %v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestTrainHashIgnoresDateProp(t *testing.T) {
+	train := Train{Title: "Ferrovia dei Parchi", MonthDay: "30/12", DepartureTime: "8:15"}
+	withDate := train
+	withDate.DateProp = "Dec 30, 2022 12:00:00 AM"
+	if train.Hash() != withDate.Hash() {
+		t.Error("Hash() changed with dateProp")
+	}
+
+	changed := train
+	changed.DepartureTime = "9:15"
+	if train.Hash() == changed.Hash() {
+		t.Error("Hash() did not change with the departure time")
+	}
+}